@@ -0,0 +1,300 @@
+package btk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/godbus/dbus"
+	"github.com/pkg/errors"
+)
+
+const (
+	adapterInterface = "org.bluez.Adapter1"
+
+	// classDeviceMask is the major and minor device class in the class of
+	// device, the rest are service classes managed by BlueZ
+	classDeviceMask = 0x001ffc
+	// classPeripheral is the peripheral major device class, the minor
+	// device class of peripherals is the HID device subclass
+	classPeripheral = 0x000500
+)
+
+// DeviceClass returns the class of device of a HID device of the subclass,
+// e.g. 0x000540 for a keyboard, see SubClass of Keyboard
+func DeviceClass(subClass uint8) uint32 {
+	return classPeripheral | uint32(subClass)
+}
+
+// Adapter is a bluetooth adapter managed by BlueZ, i.e. org.bluez.Adapter1.
+// The original value of each property is kept when it's first changed, so
+// Restore can bring the adapter back to how it was.
+type Adapter struct {
+	bus  *dbus.Conn
+	obj  dbus.BusObject
+	path dbus.ObjectPath
+
+	// saved is the original values of changed properties in the order they
+	// are changed
+	saved []savedProperty
+}
+
+type savedProperty struct {
+	name  string
+	value dbus.Variant
+}
+
+// OpenAdapter returns the adapter of the given name, e.g. hci0, or address.
+// The first adapter is returned if the name is empty.
+func OpenAdapter(name string) (*Adapter, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect system bus")
+	}
+
+	var objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	if err := bus.Object("org.bluez", "/").Call(
+		"org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0,
+	).Store(&objects); err != nil {
+		return nil, errors.Wrap(err, "failed to list bluez objects")
+	}
+
+	var paths []string
+	for path, ifaces := range objects {
+		props, ok := ifaces[adapterInterface]
+		if !ok {
+			continue
+		}
+
+		addr, _ := props["Address"].Value().(string)
+		if name == "" || strings.HasSuffix(string(path), "/"+name) || strings.EqualFold(addr, name) {
+			paths = append(paths, string(path))
+		}
+	}
+
+	if len(paths) == 0 {
+		if name == "" {
+			return nil, errors.New("no bluetooth adapter")
+		}
+		return nil, errors.Errorf("bluetooth adapter %s not found", name)
+	}
+
+	// hci0 comes before hci1
+	sort.Strings(paths)
+	path := dbus.ObjectPath(paths[0])
+
+	return &Adapter{
+		bus:  bus,
+		obj:  bus.Object("org.bluez", path),
+		path: path,
+	}, nil
+}
+
+// Path returns the object path of the adapter, e.g. /org/bluez/hci0
+func (a *Adapter) Path() dbus.ObjectPath {
+	return a.path
+}
+
+func (a *Adapter) get(name string) (dbus.Variant, error) {
+	v, err := a.obj.GetProperty(adapterInterface + "." + name)
+	return v, errors.Wrapf(err, "failed to get adapter property %s", name)
+}
+
+func (a *Adapter) set(name string, value interface{}) error {
+	old, err := a.get(name)
+	if err != nil {
+		return err
+	}
+
+	if err := a.obj.Call(
+		"org.freedesktop.DBus.Properties.Set", 0,
+		adapterInterface, name, dbus.MakeVariant(value),
+	).Err; err != nil {
+		return errors.Wrapf(err, "failed to set adapter property %s", name)
+	}
+
+	for _, p := range a.saved {
+		if p.name == name {
+			return nil
+		}
+	}
+	a.saved = append(a.saved, savedProperty{name, old})
+	return nil
+}
+
+func (a *Adapter) getBool(name string) (bool, error) {
+	v, err := a.get(name)
+	if err != nil {
+		return false, err
+	}
+	b, _ := v.Value().(bool)
+	return b, nil
+}
+
+func (a *Adapter) getString(name string) (string, error) {
+	v, err := a.get(name)
+	if err != nil {
+		return "", err
+	}
+	s, _ := v.Value().(string)
+	return s, nil
+}
+
+func (a *Adapter) getUint32(name string) (uint32, error) {
+	v, err := a.get(name)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := v.Value().(uint32)
+	return n, nil
+}
+
+// Address returns the bluetooth address of the adapter
+func (a *Adapter) Address() (string, error) {
+	return a.getString("Address")
+}
+
+// Powered tells if the adapter is powered on
+func (a *Adapter) Powered() (bool, error) {
+	return a.getBool("Powered")
+}
+
+// SetPowered powers the adapter on or off
+func (a *Adapter) SetPowered(powered bool) error {
+	return a.set("Powered", powered)
+}
+
+// Discoverable tells if the adapter is discoverable
+func (a *Adapter) Discoverable() (bool, error) {
+	return a.getBool("Discoverable")
+}
+
+// SetDiscoverable makes the adapter discoverable or not
+func (a *Adapter) SetDiscoverable(discoverable bool) error {
+	return a.set("Discoverable", discoverable)
+}
+
+// DiscoverableTimeout returns how many seconds the adapter stays
+// discoverable, 0 means forever
+func (a *Adapter) DiscoverableTimeout() (uint32, error) {
+	return a.getUint32("DiscoverableTimeout")
+}
+
+// SetDiscoverableTimeout sets how many seconds the adapter stays
+// discoverable, 0 means forever
+func (a *Adapter) SetDiscoverableTimeout(seconds uint32) error {
+	return a.set("DiscoverableTimeout", seconds)
+}
+
+// Pairable tells if the adapter accepts pairing
+func (a *Adapter) Pairable() (bool, error) {
+	return a.getBool("Pairable")
+}
+
+// SetPairable sets if the adapter accepts pairing
+func (a *Adapter) SetPairable(pairable bool) error {
+	return a.set("Pairable", pairable)
+}
+
+// Alias returns the name of the adapter shown to remote devices
+func (a *Adapter) Alias() (string, error) {
+	return a.getString("Alias")
+}
+
+// SetAlias sets the name of the adapter shown to remote devices
+func (a *Adapter) SetAlias(alias string) error {
+	return a.set("Alias", alias)
+}
+
+// Class returns the class of device of the adapter. It's read only on
+// D-Bus, the major and minor device class is set by the Class of the BlueZ
+// config, see SetClassConfig.
+func (a *Adapter) Class() (uint32, error) {
+	return a.getUint32("Class")
+}
+
+// HasDeviceClass tells if the major and minor device class of the adapter
+// are the ones of the class
+func (a *Adapter) HasDeviceClass(class uint32) (bool, error) {
+	c, err := a.Class()
+	if err != nil {
+		return false, err
+	}
+	return c&classDeviceMask == class&classDeviceMask, nil
+}
+
+// Restore sets the changed properties back to their original values, in
+// the reverse order they are changed
+func (a *Adapter) Restore() error {
+	var err error
+	for i := len(a.saved) - 1; i >= 0; i-- {
+		p := a.saved[i]
+		if e := a.obj.Call(
+			"org.freedesktop.DBus.Properties.Set", 0,
+			adapterInterface, p.name, p.value,
+		).Err; e != nil {
+			err = errors.Wrapf(e, "failed to restore adapter property %s", p.name)
+		}
+	}
+	a.saved = nil
+	return err
+}
+
+// SetClassConfig sets Class in the General section of the BlueZ config file,
+// e.g. /etc/bluetooth/main.conf. It returns false if the class is already
+// set. bluetoothd must be restarted to apply the change.
+func SetClassConfig(path string, class uint32) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	line := fmt.Sprintf("Class = 0x%06x", class)
+	lines := strings.Split(string(content), "\n")
+	section := ""
+	general := -1
+
+	for i, l := range lines {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, "[") {
+			section = strings.Trim(t, "[]")
+			if section == "General" {
+				general = i
+			}
+			continue
+		}
+
+		if section != "General" || !strings.HasPrefix(t, "Class") {
+			continue
+		}
+
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "Class" {
+			continue
+		}
+
+		v, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 0, 32)
+		if err == nil && uint32(v) == class {
+			return false, nil
+		}
+
+		lines[i] = line
+		return true, ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), info.Mode())
+	}
+
+	if general < 0 {
+		lines = append([]string{"[General]", line, ""}, lines...)
+	} else {
+		lines = append(lines[:general+1], append([]string{line}, lines[general+1:]...)...)
+	}
+
+	return true, ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), info.Mode())
+}
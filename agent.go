@@ -0,0 +1,240 @@
+package btk
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/godbus/dbus"
+	"github.com/pkg/errors"
+)
+
+// AgentCapability is the IO capability of an agent, which decides how the
+// host and btk authenticate each other when pairing
+type AgentCapability string
+
+const (
+	// CapabilityKeyboardOnly means passkeys shown on the host are typed on
+	// the keyboard, the usual way a bluetooth keyboard pairs
+	CapabilityKeyboardOnly AgentCapability = "KeyboardOnly"
+	// CapabilityKeyboardDisplay means passkeys can be typed as well as
+	// shown, e.g. in the log, and confirmed
+	CapabilityKeyboardDisplay AgentCapability = "KeyboardDisplay"
+	// CapabilityNoInputNoOutput means pairing without any passkey
+	CapabilityNoInputNoOutput AgentCapability = "NoInputNoOutput"
+)
+
+var (
+	// ErrPairingRejected is returned by agent policies to reject a request
+	ErrPairingRejected = errors.New("pairing rejected")
+	// ErrPairingCanceled is returned by agent policies when the request is
+	// given up, e.g. it's canceled by Cancel
+	ErrPairingCanceled = errors.New("pairing canceled")
+	// ErrPairingTimeout is returned by agent policies when the user doesn't
+	// decide in time
+	ErrPairingTimeout = errors.New("pairing timed out")
+)
+
+// AgentPolicy decides the pairing requests to an Agent. A nil callback
+// rejects the request, except DisplayPasskey and Cancel, which are only
+// logged. Callbacks may block until the user decides, requests are
+// handled concurrently.
+type AgentPolicy struct {
+	// RequestPasskey returns the passkey shown on the host, 0 to 999999
+	RequestPasskey func(dev dbus.ObjectPath) (uint32, error)
+	// DisplayPasskey shows the passkey to type on the host, entered is the
+	// number of digits typed so far
+	DisplayPasskey func(dev dbus.ObjectPath, passkey uint32, entered uint16)
+	// RequestConfirmation returns nil if the passkey is the same as the one
+	// shown on the host
+	RequestConfirmation func(dev dbus.ObjectPath, passkey uint32) error
+	// RequestAuthorization returns nil if the host may pair without a
+	// passkey
+	RequestAuthorization func(dev dbus.ObjectPath) error
+	// AuthorizeService returns nil if the host may connect to the service
+	// of the UUID
+	AuthorizeService func(dev dbus.ObjectPath, uuid string) error
+	// Cancel is called when the pending request is canceled by BlueZ,
+	// e.g. the host gives up pairing
+	Cancel func()
+}
+
+// Agent is a BlueZ pairing agent, i.e. org.bluez.Agent1, which answers the
+// authentication and authorization requests of the profile
+type Agent struct {
+	bus        *dbus.Conn
+	path       dbus.ObjectPath
+	capability AgentCapability
+	policy     AgentPolicy
+}
+
+// NewAgent returns an agent on the given path, on the same bus as the
+// profile
+func (p *HidProfile) NewAgent(path string, capability AgentCapability, policy AgentPolicy) *Agent {
+	return &Agent{
+		bus:        p.bus,
+		path:       dbus.ObjectPath(path),
+		capability: capability,
+		policy:     policy,
+	}
+}
+
+// Export exports the agent
+func (a *Agent) Export() error {
+	return errors.Wrap(
+		a.bus.Export(a, a.path, "org.bluez.Agent1"),
+		"failed to export agent",
+	)
+}
+
+// Register registers the agent to BlueZ as the default agent
+func (a *Agent) Register() error {
+	manager := a.bus.Object("org.bluez", "/org/bluez")
+
+	if err := manager.Call(
+		"org.bluez.AgentManager1.RegisterAgent",
+		0, a.path, string(a.capability),
+	).Err; err != nil {
+		return errors.Wrap(err, "failed to register agent")
+	}
+
+	return errors.Wrap(
+		manager.Call("org.bluez.AgentManager1.RequestDefaultAgent", 0, a.path).Err,
+		"failed to request default agent",
+	)
+}
+
+// Unregister unregisters the agent from BlueZ
+func (a *Agent) Unregister() error {
+	return a.bus.Object("org.bluez", "/org/bluez").Call(
+		"org.bluez.AgentManager1.UnregisterAgent",
+		0, a.path,
+	).Err
+}
+
+// agentError converts the error of a policy into the error BlueZ expects
+func agentError(err error) *dbus.Error {
+	if err == nil {
+		return nil
+	}
+
+	name := "org.bluez.Error.Rejected"
+	switch errors.Cause(err) {
+	case ErrPairingCanceled, ErrPairingTimeout:
+		name = "org.bluez.Error.Canceled"
+	}
+	return dbus.NewError(name, []interface{}{err.Error()})
+}
+
+func (a *Agent) logger(dev dbus.ObjectPath) *logrus.Entry {
+	return logrus.WithField("device", dev)
+}
+
+// Release is called when the agent is unregistered by BlueZ
+func (a *Agent) Release() *dbus.Error {
+	logrus.Debugln("Agent released")
+	return nil
+}
+
+// RequestPinCode is called for legacy pairing, which isn't supported
+func (a *Agent) RequestPinCode(dev dbus.ObjectPath) (string, *dbus.Error) {
+	a.logger(dev).Warnln("Legacy pairing with PIN code rejected")
+	return "", agentError(ErrPairingRejected)
+}
+
+// DisplayPinCode is called for legacy pairing, which isn't supported
+func (a *Agent) DisplayPinCode(dev dbus.ObjectPath, pincode string) *dbus.Error {
+	a.logger(dev).Warnln("Legacy pairing with PIN code rejected")
+	return agentError(ErrPairingRejected)
+}
+
+// RequestPasskey is called for the passkey shown on the host
+func (a *Agent) RequestPasskey(dev dbus.ObjectPath) (uint32, *dbus.Error) {
+	logger := a.logger(dev)
+	logger.Infoln("Passkey requested")
+
+	if a.policy.RequestPasskey == nil {
+		logger.Warnln("No way to enter passkey, pairing rejected")
+		return 0, agentError(ErrPairingRejected)
+	}
+
+	passkey, err := a.policy.RequestPasskey(dev)
+	if err != nil {
+		logger.WithError(err).Warnln("Passkey not entered")
+		return 0, agentError(err)
+	}
+	return passkey, nil
+}
+
+// DisplayPasskey is called with the passkey to type on the host, every time
+// a digit is typed
+func (a *Agent) DisplayPasskey(dev dbus.ObjectPath, passkey uint32, entered uint16) *dbus.Error {
+	if a.policy.DisplayPasskey == nil {
+		a.logger(dev).WithField("entered", entered).
+			Infof("Type passkey %06d on the host", passkey)
+		return nil
+	}
+
+	a.policy.DisplayPasskey(dev, passkey, entered)
+	return nil
+}
+
+// RequestConfirmation is called to confirm the passkey is the same as the
+// one shown on the host
+func (a *Agent) RequestConfirmation(dev dbus.ObjectPath, passkey uint32) *dbus.Error {
+	logger := a.logger(dev).WithField("passkey", passkey)
+	logger.Infoln("Passkey confirmation requested")
+
+	if a.policy.RequestConfirmation == nil {
+		logger.Warnln("No way to confirm passkey, pairing rejected")
+		return agentError(ErrPairingRejected)
+	}
+
+	err := a.policy.RequestConfirmation(dev, passkey)
+	if err != nil {
+		logger.WithError(err).Warnln("Passkey not confirmed")
+	}
+	return agentError(err)
+}
+
+// RequestAuthorization is called to pair without a passkey
+func (a *Agent) RequestAuthorization(dev dbus.ObjectPath) *dbus.Error {
+	logger := a.logger(dev)
+	logger.Infoln("Pairing authorization requested")
+
+	if a.policy.RequestAuthorization == nil {
+		logger.Warnln("Pairing without passkey rejected")
+		return agentError(ErrPairingRejected)
+	}
+
+	err := a.policy.RequestAuthorization(dev)
+	if err != nil {
+		logger.WithError(err).Warnln("Pairing not authorized")
+	}
+	return agentError(err)
+}
+
+// AuthorizeService is called when the host connects to a service, e.g. the
+// HID profile
+func (a *Agent) AuthorizeService(dev dbus.ObjectPath, uuid string) *dbus.Error {
+	logger := a.logger(dev).WithField("uuid", uuid)
+	logger.Infoln("Service authorization requested")
+
+	if a.policy.AuthorizeService == nil {
+		logger.Warnln("No way to authorize service, connection rejected")
+		return agentError(ErrPairingRejected)
+	}
+
+	err := a.policy.AuthorizeService(dev, uuid)
+	if err != nil {
+		logger.WithError(err).Warnln("Service not authorized")
+	}
+	return agentError(err)
+}
+
+// Cancel is called when the pending request is canceled
+func (a *Agent) Cancel() *dbus.Error {
+	logrus.Infoln("Pairing request canceled")
+
+	if a.policy.Cancel != nil {
+		a.policy.Cancel()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package btk
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// ledBlinkInterval is how long the LEDs stay on or off while blinking
+const ledBlinkInterval = 300 * time.Millisecond
+
+// ErrKeyboardInUse is returned by Authorize while a client is connected, the
+// host isn't asked about since the user is typing to the client
+var ErrKeyboardInUse = errors.New("keyboard in use")
+
+// Authorize asks the user of the keyboard whether to accept a host, e.g. a
+// new connection. The LEDs blink until the confirm chord or reject chord is
+// pressed, and the input doesn't go to the client meanwhile. It returns nil
+// if the host is accepted, ErrPairingRejected if it's rejected,
+// ErrPairingTimeout if it's not decided within the timeout, or
+// ErrPairingCanceled if it's canceled by CancelInput. ErrKeyboardInUse is returned without asking while a client
+// is connected.
+func (kb *Keyboard) Authorize(confirm, reject Chord, timeout time.Duration) error {
+	if client := kb.Client(); client != nil {
+		return errors.Wrapf(ErrKeyboardInUse, "connected to %s", client.Dev)
+	}
+
+	g, err := kb.grabKeys()
+	if err != nil {
+		return err
+	}
+	defer kb.ungrab(g)
+
+	stop := make(chan struct{})
+	blinking := make(chan struct{})
+	go func() {
+		kb.blinkLEDs(stop)
+		close(blinking)
+	}()
+	defer func() {
+		close(stop)
+		<-blinking
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"confirm": confirm,
+		"reject":  reject,
+	}).Warnln("Press the confirm keys on the keyboard to accept the host")
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case p := <-g.presses:
+			switch {
+			case confirm.pressedBy(p):
+				return nil
+			case reject.pressedBy(p):
+				return ErrPairingRejected
+			}
+		case <-timer.C:
+			return ErrPairingTimeout
+		case <-g.cancel:
+			return ErrPairingCanceled
+		case <-kb.done:
+			return ErrPairingCanceled
+		}
+	}
+}
+
+// blinkLEDs blinks all LEDs of the keyboard until stop is closed, then the
+// LEDs of the client are set back
+func (kb *Keyboard) blinkLEDs(stop <-chan struct{}) {
+	id, ok := kb.report.findReport(reportOutput, pageLED)
+	if !ok {
+		return
+	}
+	defer kb.applyOutput()
+
+	ticker := time.NewTicker(ledBlinkInterval)
+	defer ticker.Stop()
+
+	on := false
+	for {
+		on = !on
+		leds := uint8(0)
+		if on {
+			leds = 0xff
+		}
+
+		if err := writeOutput(kb.source(), kb.report.encode(reportOutput, id, ledValues(leds))); err != nil {
+			logrus.WithError(err).Debugln("Failed to blink LEDs")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package btk
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// modKeys returns a boot keyboard report of the modifiers and keys
+func modKeys(mods uint8, keys ...uint8) []byte {
+	r := bootKeys(keys...)
+	r[0] = mods
+	return r
+}
+
+// authorize starts Authorize on a keyboard without a client, and waits until
+// the keyboard input is grabbed for it
+func authorize(t *testing.T, timeout time.Duration) (*Keyboard, *MemorySource, <-chan error) {
+	t.Helper()
+
+	src := NewMemorySource(bootKeyboardDesc)
+	kb := NewKeyboardWithSource(src)
+	go kb.HandleHID()
+
+	confirm, _ := ParseChord("ctrl+y")
+	reject, _ := ParseChord("ctrl+n")
+
+	result := make(chan error, 1)
+	go func() {
+		result <- kb.Authorize(confirm, reject, timeout)
+	}()
+	waitGrab(t, kb)
+
+	return kb, src, result
+}
+
+func expectAuthorized(t *testing.T, result <-chan error, want error) {
+	t.Helper()
+
+	select {
+	case err := <-result:
+		if errors.Cause(err) != want {
+			t.Errorf("Authorize returned %v, want %v", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Authorize not returned")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name    string
+		reports [][]byte
+		want    error
+	}{
+		{"confirm", [][]byte{modKeys(0x01), modKeys(0x01, 0x1c)}, nil},
+		{"right ctrl", [][]byte{modKeys(0x10), modKeys(0x10, 0x1c)}, nil},
+		{"reject", [][]byte{modKeys(0x01), modKeys(0x01, 0x11)}, ErrPairingRejected},
+		// keys of the chord pressed apart don't count
+		{"apart", [][]byte{bootKeys(0x1c), bootKeys(), modKeys(0x01), modKeys(0x01, 0x11)}, ErrPairingRejected},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kb, src, result := authorize(t, 5*time.Second)
+			defer kb.Stop()
+
+			for _, r := range test.reports {
+				src.Send(r)
+			}
+			expectAuthorized(t, result, test.want)
+		})
+	}
+}
+
+func TestAuthorizeTimeout(t *testing.T) {
+	kb, _, result := authorize(t, 50*time.Millisecond)
+	defer kb.Stop()
+
+	expectAuthorized(t, result, ErrPairingTimeout)
+}
+
+func TestAuthorizeCanceled(t *testing.T) {
+	kb, src, result := authorize(t, 5*time.Second)
+	defer kb.Stop()
+
+	// the LEDs blink until it's decided, then they're set back
+	deadline := time.Now().Add(5 * time.Second)
+	for !containsReport(src.Outputs(), []byte{0x1f}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("LEDs not blinking, got %x", src.Outputs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	kb.CancelInput()
+	expectAuthorized(t, result, ErrPairingCanceled)
+
+	out := src.Outputs()
+	if last := out[len(out)-1]; !bytes.Equal(last, []byte{0x00}) {
+		t.Errorf("LEDs left at %x", last)
+	}
+}
+
+func TestAuthorizeInUse(t *testing.T) {
+	h := connectHost(t)
+	defer h.close()
+
+	confirm, _ := ParseChord("ctrl+y")
+	reject, _ := ParseChord("ctrl+n")
+	if err := h.kb.Authorize(confirm, reject, time.Second); errors.Cause(err) != ErrKeyboardInUse {
+		t.Errorf("Authorize returned %v while a client is connected", err)
+	}
+}
+
+func containsReport(reports [][]byte, report []byte) bool {
+	for _, r := range reports {
+		if bytes.Equal(r, report) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package btk
+
+const (
+	// HIDP boot protocol reports are always prefixed by these report IDs,
+	// whatever the HID descriptor says
+	bootReportKeyboard = 1
+	bootReportMouse    = 2
+
+	// bootMouseButtons is the number of buttons in a boot mouse report
+	bootMouseButtons = 3
+)
+
+// bootTranslator translates report protocol reports of a HID descriptor
+// into boot protocol reports, for hosts selecting the boot protocol, e.g.
+// BIOS setups. Keyboard reports of all report IDs, including NKRO bitmaps,
+// are merged into one boot keyboard report.
+type bootTranslator struct {
+	desc  *reportDesc
+	held  heldKeys
+	state keyState
+	// buttons and leds are the last boot mouse buttons and boot keyboard
+	// LEDs, for GET_REPORT
+	buttons uint8
+	leds    uint8
+}
+
+func newBootTranslator(desc *reportDesc) *bootTranslator {
+	return &bootTranslator{
+		desc: desc,
+		held: heldKeys{},
+	}
+}
+
+// hasInput tells if the input report of the ID has any usage on the page
+func (t *bootTranslator) hasInput(id uint8, page uint16) bool {
+	for _, f := range t.desc.fields {
+		if f.typ == reportInput && f.reportID == id && !f.isConstant() && f.hasUsagePage(page) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *bootTranslator) hasPointer(id uint8) bool {
+	for _, f := range t.desc.fields {
+		if f.typ == reportInput && f.reportID == id && f.hasUsage(usageX) {
+			return true
+		}
+	}
+	return false
+}
+
+// input translates a report protocol input report into a boot report with
+// the boot report ID, it returns false if there's nothing to send, e.g. the
+// report is of media keys or doesn't change the boot keyboard report
+func (t *bootTranslator) input(report []byte) ([]byte, bool) {
+	id, _ := t.desc.reportPayload(report)
+
+	switch {
+	case t.hasInput(id, pageKeyboard):
+		if !t.held.update(t.desc, report) {
+			return nil, false
+		}
+
+		if !t.state.set(t.held.union(map[uint8]bool{})) {
+			return nil, false
+		}
+		return append([]byte{bootReportKeyboard}, t.state.bootReport()...), true
+	case t.hasPointer(id):
+		r := []byte{bootReportMouse, 0, 0, 0}
+		for _, v := range t.desc.values(reportInput, report) {
+			switch {
+			case v.usage.page() == pageButton:
+				if b := v.usage.id(); b >= 1 && b <= bootMouseButtons && v.value != 0 {
+					r[1] |= 1 << (b - 1)
+				}
+			case v.usage == usageX:
+				r[2] = uint8(clampInt8(v.value))
+			case v.usage == usageY:
+				r[3] = uint8(clampInt8(v.value))
+			}
+		}
+		t.buttons = r[1]
+		return r, true
+	}
+
+	return nil, false
+}
+
+// output translates a boot keyboard output report into the output report of
+// the descriptor carrying LEDs, it returns false if there isn't one
+func (t *bootTranslator) output(report []byte) ([]byte, bool) {
+	id, ok := t.desc.findReport(reportOutput, pageLED)
+	if !ok || len(report) < 1 {
+		return nil, false
+	}
+	t.leds = report[0]
+	return t.desc.encode(reportOutput, id, ledValues(report[0])), true
+}
+
+// report returns the current boot report of the type and boot report ID, it
+// returns false if there's no such report
+func (t *bootTranslator) report(typ ReportType, id uint8) ([]byte, bool) {
+	switch {
+	case typ == ReportInput && id == bootReportKeyboard:
+		return append([]byte{id}, t.state.bootReport()...), true
+	case typ == ReportOutput && id == bootReportKeyboard:
+		return []byte{id, t.leds}, true
+	case typ == ReportInput && id == bootReportMouse && isPointer(t.desc):
+		// mouse movements are relative, only the buttons are a state
+		return []byte{id, t.buttons, 0, 0}, true
+	}
+	return nil, false
+}
+
+func clampInt8(v int32) int8 {
+	switch {
+	case v < -127:
+		return -127
+	case v > 127:
+		return 127
+	}
+	return int8(v)
+}
@@ -0,0 +1,262 @@
+package btk
+
+import (
+	"bytes"
+	"testing"
+)
+
+// nkroKeyboardDesc is an NKRO keyboard without report IDs, the input report
+// is the modifiers followed by a bitmap of keys 0x00 to 0x67
+var nkroKeyboardDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xa1, 0x01, // Collection (Application)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0xe0, //   Usage Minimum (Left Control)
+	0x29, 0xe7, //   Usage Maximum (Right GUI)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Variable, Absolute)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, 0x67, //   Usage Maximum (103)
+	0x95, 0x68, //   Report Count (104)
+	0x81, 0x02, //   Input (Data, Variable, Absolute)
+	0x05, 0x08, //   Usage Page (LEDs)
+	0x19, 0x01, //   Usage Minimum (Num Lock)
+	0x29, 0x05, //   Usage Maximum (Kana)
+	0x95, 0x05, //   Report Count (5)
+	0x91, 0x02, //   Output (Data, Variable, Absolute)
+	0x95, 0x03, //   Report Count (3)
+	0x91, 0x01, //   Output (Constant)
+	0xc0, // End Collection
+}
+
+// nkroKeys returns an input report of nkroKeyboardDesc
+func nkroKeys(mods uint8, keys ...uint8) []byte {
+	r := make([]byte, 1+0x68/8)
+	r[0] = mods
+	for _, k := range keys {
+		r[1+k/8] |= 1 << (k % 8)
+	}
+	return r
+}
+
+// compositeDesc has media keys as report 1, a keyboard as report 2 and a
+// mouse as report 3, none of which are the boot report IDs
+var compositeDesc = []byte{
+	0x05, 0x0c, // Usage Page (Consumer)
+	0x09, 0x01, // Usage (Consumer Control)
+	0xa1, 0x01, // Collection (Application)
+	0x85, 0x01, //   Report ID (1)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x03, //   Logical Maximum (1023)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x2a, 0xff, 0x03, //   Usage Maximum (1023)
+	0x75, 0x10, //   Report Size (16)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x00, //   Input (Data, Array)
+	0xc0,       // End Collection
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xa1, 0x01, // Collection (Application)
+	0x85, 0x02, //   Report ID (2)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0xe0, //   Usage Minimum (Left Control)
+	0x29, 0xe7, //   Usage Maximum (Right GUI)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Variable, Absolute)
+	0x95, 0x05, //   Report Count (5)
+	0x05, 0x08, //   Usage Page (LEDs)
+	0x19, 0x01, //   Usage Minimum (Num Lock)
+	0x29, 0x05, //   Usage Maximum (Kana)
+	0x91, 0x02, //   Output (Data, Variable, Absolute)
+	0x95, 0x03, //   Report Count (3)
+	0x91, 0x01, //   Output (Constant)
+	0x95, 0x06, //   Report Count (6)
+	0x75, 0x08, //   Report Size (8)
+	0x25, 0x65, //   Logical Maximum (101)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, 0x65, //   Usage Maximum (101)
+	0x81, 0x00, //   Input (Data, Array)
+	0xc0,       // End Collection
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xa1, 0x01, // Collection (Application)
+	0x85, 0x03, //   Report ID (3)
+	0x09, 0x01, //   Usage (Pointer)
+	0xa1, 0x00, //   Collection (Physical)
+	0x05, 0x09, //     Usage Page (Button)
+	0x19, 0x01, //     Usage Minimum (1)
+	0x29, 0x05, //     Usage Maximum (5)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x95, 0x05, //     Report Count (5)
+	0x75, 0x01, //     Report Size (1)
+	0x81, 0x02, //     Input (Data, Variable, Absolute)
+	0x95, 0x01, //     Report Count (1)
+	0x75, 0x03, //     Report Size (3)
+	0x81, 0x01, //     Input (Constant)
+	0x05, 0x01, //     Usage Page (Generic Desktop)
+	0x09, 0x30, //     Usage (X)
+	0x09, 0x31, //     Usage (Y)
+	0x16, 0x00, 0x80, //     Logical Minimum (-32768)
+	0x26, 0xff, 0x7f, //     Logical Maximum (32767)
+	0x75, 0x10, //     Report Size (16)
+	0x95, 0x02, //     Report Count (2)
+	0x81, 0x06, //     Input (Data, Variable, Relative)
+	0xc0, //   End Collection
+	0xc0, // End Collection
+}
+
+// compositeKeys returns a keyboard input report of compositeDesc
+func compositeKeys(mods uint8, keys ...uint8) []byte {
+	r := make([]byte, 8)
+	r[0], r[1] = 2, mods
+	copy(r[2:], keys)
+	return r
+}
+
+// bootReport returns a boot keyboard input report with the boot report ID
+func bootReport(mods uint8, keys ...uint8) []byte {
+	r := bootKeys(keys...)
+	r[0] = mods
+	return append([]byte{bootReportKeyboard}, r...)
+}
+
+// bootStep is an input report and its boot report, nil if none is sent
+type bootStep struct {
+	report []byte
+	want   []byte
+}
+
+func TestBootTranslatorInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		desc  []byte
+		steps []bootStep
+	}{
+		{
+			"nkro",
+			nkroKeyboardDesc,
+			[]bootStep{
+				{nkroKeys(0, 0x04), bootReport(0, 0x04)},
+				{nkroKeys(0x02, 0x04, 0x05), bootReport(0x02, 0x04, 0x05)},
+				// nothing changed
+				{nkroKeys(0x02, 0x04, 0x05), nil},
+				// keys already held keep their slots
+				{nkroKeys(0x02, 0x05, 0x06), bootReport(0x02, 0x05, 0x06)},
+				// more than 6 keys can't fit in a boot report
+				{nkroKeys(0, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a), bootReport(0, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01)},
+				{nkroKeys(0, 0x05, 0x06), bootReport(0, 0x05, 0x06)},
+				{nkroKeys(0), bootReport(0)},
+			},
+		},
+		{
+			"composite",
+			compositeDesc,
+			[]bootStep{
+				// the keyboard report ID is replaced by the boot one
+				{compositeKeys(0x01, 0x04), bootReport(0x01, 0x04)},
+				// media keys have no boot report
+				{[]byte{1, 0xe9, 0x00}, nil},
+				// X and Y are clamped to the boot mouse report
+				{[]byte{3, 0x05, 0x10, 0x00, 0x00, 0x80}, []byte{bootReportMouse, 0x05, 0x10, 0x81}},
+				// keys of a rolled over report are ignored
+				{compositeKeys(0, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01), nil},
+				{compositeKeys(0), bootReport(0)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		tr := newBootTranslator(mustParseDesc(test.desc))
+		for i, step := range test.steps {
+			r, ok := tr.input(step.report)
+			if ok != (step.want != nil) || !bytes.Equal(r, step.want) {
+				t.Errorf("%s: report %d translated to %x, %v, want %x", test.name, i, r, ok, step.want)
+			}
+		}
+	}
+}
+
+func TestBootTranslatorOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		desc []byte
+		leds []byte
+		want []byte
+	}{
+		{"nkro", nkroKeyboardDesc, []byte{0x02}, []byte{0x02}},
+		// unused LED bits are dropped
+		{"nkro kana", nkroKeyboardDesc, []byte{0xff}, []byte{0x1f}},
+		{"composite", compositeDesc, []byte{0x03}, []byte{2, 0x03}},
+		{"no leds", bootMouseDesc, []byte{0x02}, nil},
+		{"empty", nkroKeyboardDesc, nil, nil},
+	}
+
+	for _, test := range tests {
+		tr := newBootTranslator(mustParseDesc(test.desc))
+		r, ok := tr.output(test.leds)
+		if ok != (test.want != nil) || !bytes.Equal(r, test.want) {
+			t.Errorf("%s: LEDs %x translated to %x, %v, want %x", test.name, test.leds, r, ok, test.want)
+		}
+	}
+}
+
+func TestKeyboardBootProtocol(t *testing.T) {
+	src := NewMemorySource(compositeDesc)
+	h := connectKeyboard(t, NewKeyboardWithSource(src))
+	defer h.close()
+	h.src = src
+
+	h.send(compositeKeys(0x02, 0x04))
+	h.expectInput(compositeKeys(0x02, 0x04))
+
+	setProtocol := func(p Protocol) {
+		t.Helper()
+		if _, err := h.ctrl.Write(Message{Type: TransSetProtocol, Param: uint8(p)}.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if p := h.read(h.ctrl); !bytes.Equal(p, Handshake(HandshakeSuccessful).Bytes()) {
+			t.Fatalf("SET_PROTOCOL replied %x, want SUCCESSFUL", p)
+		}
+	}
+
+	setProtocol(ProtocolBoot)
+
+	// keys held before the switch are in the boot report
+	h.send(compositeKeys(0x02, 0x04, 0x05))
+	h.expectInput(bootReport(0x02, 0x04, 0x05))
+
+	// boot LEDs go to the output report of the keyboard
+	if _, err := h.intr.Write(DataMessage(ReportOutput, []byte{bootReportKeyboard, 0x02}).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	h.expectOutput([]byte{2, 0x02})
+
+	// GET_REPORT takes the boot report IDs
+	for _, want := range []Message{
+		DataMessage(ReportInput, bootReport(0x02, 0x04, 0x05)),
+		DataMessage(ReportOutput, []byte{bootReportKeyboard, 0x02}),
+		DataMessage(ReportInput, []byte{bootReportMouse, 0, 0, 0}),
+	} {
+		get := Message{Type: TransGetReport, Param: uint8(want.ReportType()), Data: want.Data[:1]}
+		if _, err := h.ctrl.Write(get.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if p := h.read(h.ctrl); !bytes.Equal(p, want.Bytes()) {
+			t.Errorf("GET_REPORT %v replied %x, want %x", get, p, want.Bytes())
+		}
+	}
+
+	setProtocol(ProtocolReport)
+
+	h.send(compositeKeys(0))
+	h.expectInput(compositeKeys(0))
+}
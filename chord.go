@@ -0,0 +1,99 @@
+package btk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// keyNames is the usage IDs of named keys, modifiers without a side match
+// either of them
+var keyNames = map[string][]uint8{
+	"enter":     {usageEnter},
+	"esc":       {usageEscape},
+	"escape":    {usageEscape},
+	"backspace": {usageBackspace},
+	"tab":       {0x2b},
+	"space":     {0x2c},
+
+	"ctrl":   {0xe0, 0xe4},
+	"shift":  {0xe1, 0xe5},
+	"alt":    {0xe2, 0xe6},
+	"gui":    {0xe3, 0xe7},
+	"lctrl":  {0xe0},
+	"lshift": {0xe1},
+	"lalt":   {0xe2},
+	"lgui":   {0xe3},
+	"rctrl":  {0xe4},
+	"rshift": {0xe5},
+	"ralt":   {0xe6},
+	"rgui":   {0xe7},
+}
+
+func init() {
+	for c := 'a'; c <= 'z'; c++ {
+		keyNames[string(c)] = []uint8{uint8(0x04 + c - 'a')}
+	}
+	for d := '1'; d <= '9'; d++ {
+		keyNames[string(d)] = []uint8{uint8(usageKey1 + d - '1')}
+	}
+	keyNames["0"] = []uint8{usageKey0}
+	for i := 1; i <= 12; i++ {
+		keyNames[fmt.Sprintf("f%d", i)] = []uint8{uint8(0x3a + i - 1)}
+	}
+}
+
+// Chord is a combination of keys pressed together on the keyboard, e.g.
+// ctrl+alt+y
+type Chord struct {
+	name string
+	// keys is the usage IDs of each key of the chord, any of which can be
+	// held for the key
+	keys [][]uint8
+}
+
+// ParseChord parses keys separated by +, e.g. ctrl+alt+y. Keys are named
+// by letters, digits, f1 to f12, enter, esc, backspace, tab, space and
+// modifiers, i.e. ctrl, shift, alt and gui, optionally prefixed by l or r
+// for the left or right one.
+func ParseChord(s string) (Chord, error) {
+	c := Chord{name: s}
+	for _, name := range strings.Split(s, "+") {
+		usages, ok := keyNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return Chord{}, errors.Errorf("unknown key %q in chord %q", name, s)
+		}
+		c.keys = append(c.keys, usages)
+	}
+	return c, nil
+}
+
+func (c Chord) String() string {
+	return c.name
+}
+
+// pressedBy tells if the key press completes the chord, i.e. the key is of
+// the chord and all keys of the chord are held
+func (c Chord) pressedBy(p keyPress) bool {
+	if len(c.keys) == 0 {
+		return false
+	}
+
+	of := false
+	for _, usages := range c.keys {
+		held := false
+		for _, u := range usages {
+			if u == p.usage {
+				of = true
+			}
+			if p.held[u] {
+				held = true
+			}
+		}
+		if !held {
+			return false
+		}
+	}
+	return of
+}
@@ -0,0 +1,79 @@
+package btk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChord(t *testing.T) {
+	tests := []struct {
+		s    string
+		keys [][]uint8
+		ok   bool
+	}{
+		{"ctrl+alt+y", [][]uint8{{0xe0, 0xe4}, {0xe2, 0xe6}, {0x1c}}, true},
+		{" RCtrl + N ", [][]uint8{{0xe4}, {0x11}}, true},
+		{"lgui+f12", [][]uint8{{0xe3}, {0x45}}, true},
+		{"shift+0", [][]uint8{{0xe1, 0xe5}, {usageKey0}}, true},
+		{"esc", [][]uint8{{usageEscape}}, true},
+		{"", nil, false},
+		{"ctrl+", nil, false},
+		{"ctrl++y", nil, false},
+		{"ctrl-y", nil, false},
+		{"f13", nil, false},
+		{"hyper+y", nil, false},
+	}
+
+	for _, test := range tests {
+		c, err := ParseChord(test.s)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("ParseChord(%q) error %v", test.s, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(c.keys, test.keys) {
+			t.Errorf("ParseChord(%q) keys %x, want %x", test.s, c.keys, test.keys)
+		}
+		if c.String() != test.s {
+			t.Errorf("ParseChord(%q).String() = %q", test.s, c)
+		}
+	}
+}
+
+func TestChordPressedBy(t *testing.T) {
+	chord, err := ParseChord("ctrl+alt+y")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	held := func(keys ...uint8) map[uint8]bool {
+		m := make(map[uint8]bool)
+		for _, k := range keys {
+			m[k] = true
+		}
+		return m
+	}
+
+	tests := []struct {
+		name  string
+		chord Chord
+		press keyPress
+		want  bool
+	}{
+		{"all held", chord, keyPress{0x1c, held(0xe0, 0xe2, 0x1c)}, true},
+		{"right modifiers", chord, keyPress{0x1c, held(0xe4, 0xe6, 0x1c)}, true},
+		{"modifier last", chord, keyPress{0xe2, held(0xe0, 0xe2, 0x1c)}, true},
+		{"more keys held", chord, keyPress{0x1c, held(0xe0, 0xe1, 0xe2, 0x1c)}, true},
+		{"missing key", chord, keyPress{0x1c, held(0xe0, 0x1c)}, false},
+		{"not of the chord", chord, keyPress{0x1d, held(0xe0, 0xe2, 0x1c, 0x1d)}, false},
+		{"empty chord", Chord{}, keyPress{0x1c, held(0x1c)}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.chord.pressedBy(test.press); got != test.want {
+			t.Errorf("%s: pressedBy %v, want %v", test.name, got, test.want)
+		}
+	}
+}
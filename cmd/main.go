@@ -1,11 +1,16 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
-	"os/exec"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/godbus/dbus"
 	"github.com/inoc603/btk"
 	"github.com/pkg/errors"
 )
@@ -16,17 +21,355 @@ func exitOnError(msg string, err error) {
 	}
 }
 
+// userInterrupt returns a channel of SIGINT and SIGTERM, which stop the
+// keyboard and restore the adapter
 func userInterrupt() chan os.Signal {
-	ch := make(chan os.Signal)
-	signal.Notify(ch, os.Interrupt)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	return ch
 }
 
+// userUnpair returns a channel of SIGUSR1, which unpairs the connected host
+func userUnpair() chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	return ch
+}
+
+var (
+	evdev = flag.String("evdev", "", "read from the given input device instead of a usb keyboard, "+
+		"e.g. /dev/input/event0, a name in /dev/input/by-id, or the device name. "+
+		"Separate several devices by comma to merge them into one keyboard")
+	hidraw = flag.String("hidraw", "", "relay the given hidraw device instead of a usb keyboard, "+
+		"e.g. /dev/hidraw0")
+
+	list      = flag.Bool("list", false, "list usb HID devices and exit")
+	merge     = flag.Bool("merge", false, "merge all matching usb keyboards into one keyboard")
+	mouse     = flag.Bool("mouse", false, "relay the first usb mouse along with the keyboard, whenever it's plugged")
+	usbID     = flag.String("usb-id", "", "use the usb keyboard of the given vendor:product ID, e.g. 046d:c31c")
+	usbSerial = flag.String("usb-serial", "", "use the usb keyboard of the given serial number")
+	usbBus    = flag.String("usb-bus", "", "use the usb keyboard on the given port, e.g. 1-1.2")
+	usbIntf   = flag.Int("usb-interface", -1, "use the given interface of the usb keyboard")
+
+	adapterName = flag.String("adapter", "", "use the given bluetooth adapter, e.g. hci0 or its address, "+
+		"instead of the first one")
+	alias        = flag.String("alias", "", "set the bluetooth name of the adapter")
+	bluezConfig  = flag.String("bluez-config", "/etc/bluetooth/main.conf", "the BlueZ config file")
+	setClassConf = flag.Bool("set-class-config", false, "set the device class in the BlueZ config if it's "+
+		"not a keyboard, bluetoothd must be restarted afterwards")
+	agentCap = flag.String("agent", string(btk.CapabilityKeyboardOnly), "register a pairing agent of the "+
+		"given capability, e.g. KeyboardOnly or KeyboardDisplay, empty to use another agent like bluetoothctl")
+	confirmKeys   = flag.String("confirm-keys", "enter", "keys pressed together to accept a new host, e.g. ctrl+alt+y")
+	rejectKeys    = flag.String("reject-keys", "esc", "keys pressed together to reject a new host")
+	authTimeout   = flag.Duration("authorize-timeout", 30*time.Second, "turn a new host away if it's not accepted in time")
+	blockRejected = flag.Bool("block-rejected", false, "block hosts rejected by the reject keys, "+
+		"until they're unblocked by bluetoothctl unblock <address>")
+)
+
+// agentPolicy accepts pairing from any host. Passkeys shown on the host are
+// typed on the keyboard, others are only logged to be compared with the ones
+// on the host. New hosts are accepted by the confirm keys on the keyboard,
+// then trusted.
+func agentPolicy(hidp *btk.HidProfile, kb *btk.Keyboard) (btk.AgentPolicy, error) {
+	confirm, err := btk.ParseChord(*confirmKeys)
+	if err != nil {
+		return btk.AgentPolicy{}, err
+	}
+
+	reject, err := btk.ParseChord(*rejectKeys)
+	if err != nil {
+		return btk.AgentPolicy{}, err
+	}
+
+	// authorize asks the user about the host. With -block-rejected, a host
+	// rejected by the keys is blocked so it isn't asked about again, while
+	// one not answered in time may ask again.
+	authorize := func(dev dbus.ObjectPath) error {
+		err := kb.Authorize(confirm, reject, *authTimeout)
+		if *blockRejected && errors.Cause(err) == btk.ErrPairingRejected {
+			logrus.WithField("device", dev).Warnln("Host rejected, blocking it")
+			if err := hidp.BlockDevice(dev); err != nil {
+				logrus.WithError(err).Warnln("Failed to block host")
+			}
+		}
+		return err
+	}
+
+	return btk.AgentPolicy{
+		RequestPasskey: func(dbus.ObjectPath) (uint32, error) {
+			return kb.ReadPasskey()
+		},
+		// pairing without typing a passkey has to be accepted on the
+		// keyboard as well, or anyone nearby could pair
+		RequestConfirmation: func(dev dbus.ObjectPath, passkey uint32) error {
+			logrus.WithField("device", dev).
+				Warnf("Accept pairing if the host shows passkey %06d", passkey)
+			return authorize(dev)
+		},
+		RequestAuthorization: func(dev dbus.ObjectPath) error {
+			logrus.WithField("device", dev).Warnln("Accept pairing with the host")
+			return authorize(dev)
+		},
+		AuthorizeService: func(dev dbus.ObjectPath, uuid string) error {
+			if err := authorize(dev); err != nil {
+				return err
+			}
+
+			logrus.WithField("device", dev).Infoln("Host accepted")
+			if err := hidp.TrustDevice(dev); err != nil {
+				logrus.WithError(err).Warnln("Failed to trust host")
+			}
+			return nil
+		},
+		Cancel: kb.CancelInput,
+	}, nil
+}
+
+// registerAgent registers the pairing agent, unless another agent is used
+func registerAgent(hidp *btk.HidProfile, kb *btk.Keyboard) (*btk.Agent, error) {
+	if *agentCap == "" {
+		return nil, nil
+	}
+
+	policy, err := agentPolicy(hidp, kb)
+	if err != nil {
+		return nil, err
+	}
+
+	agent := hidp.NewAgent("/red/potch/agent", btk.AgentCapability(*agentCap), policy)
+	if err := agent.Export(); err != nil {
+		return nil, err
+	}
+	return agent, agent.Register()
+}
+
+// setupAdapter makes the adapter discoverable and pairable as the keyboard,
+// changed properties are restored by Restore of the adapter
+func setupAdapter(kb *btk.Keyboard) (*btk.Adapter, error) {
+	adapter, err := btk.OpenAdapter(*adapterName)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := []func() error{
+		func() error { return adapter.SetPowered(true) },
+		func() error { return adapter.SetPairable(true) },
+		func() error { return adapter.SetDiscoverableTimeout(0) },
+		func() error { return adapter.SetDiscoverable(true) },
+	}
+	if *alias != "" {
+		steps = append(steps, func() error { return adapter.SetAlias(*alias) })
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			adapter.Restore()
+			return nil, err
+		}
+	}
+
+	checkClass(adapter, btk.DeviceClass(kb.SubClass()))
+
+	return adapter, nil
+}
+
+// checkClass warns if the adapter doesn't show up as a keyboard, which can
+// only be fixed in the BlueZ config
+func checkClass(adapter *btk.Adapter, class uint32) {
+	ok, err := adapter.HasDeviceClass(class)
+	if err != nil {
+		logrus.WithError(err).Warnln("Failed to get device class")
+		return
+	}
+	if ok {
+		return
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"class":  fmt.Sprintf("0x%06x", class),
+		"config": *bluezConfig,
+	})
+
+	if !*setClassConf {
+		logger.Warnln("Adapter is not a keyboard, set Class in the BlueZ config or use -set-class-config")
+		return
+	}
+
+	changed, err := btk.SetClassConfig(*bluezConfig, class)
+	if err != nil {
+		logger.WithError(err).Warnln("Failed to set device class in the BlueZ config")
+		return
+	}
+	if changed {
+		logger.Warnln("Device class set in the BlueZ config, restart bluetoothd to apply")
+	}
+}
+
+func listDevices() {
+	for _, d := range btk.ListUsbDevices() {
+		fmt.Printf("%04x:%04x interface %d protocol %d bus %s serial %q (%s)\n",
+			d.Vendor, d.Product, d.Interface, d.Protocol, d.BusPath, d.Serial, d.Path)
+	}
+}
+
+func usbMatchers() ([]btk.DeviceMatcher, error) {
+	var matchers []btk.DeviceMatcher
+
+	if *usbID != "" {
+		var vendor, product uint16
+		if _, err := fmt.Sscanf(*usbID, "%x:%x", &vendor, &product); err != nil {
+			return nil, errors.Wrap(err, "invalid usb id")
+		}
+		matchers = append(matchers, btk.MatchID(vendor, product))
+	}
+
+	if *usbSerial != "" {
+		matchers = append(matchers, btk.MatchSerial(*usbSerial))
+	}
+
+	if *usbBus != "" {
+		matchers = append(matchers, btk.MatchBusPath(*usbBus))
+	}
+
+	if *usbIntf >= 0 {
+		matchers = append(matchers, btk.MatchInterface(uint8(*usbIntf)))
+	} else if len(matchers) > 0 {
+		matchers = append(matchers, btk.MatchKeyboard)
+	}
+
+	return matchers, nil
+}
+
+type opener func() (btk.InputSource, error)
+
+func keyboardOpener() (opener, error) {
+	switch {
+	case *evdev != "":
+		return openEvdev, nil
+	case *hidraw != "":
+		return func() (btk.InputSource, error) {
+			return btk.OpenHidraw(*hidraw)
+		}, nil
+	}
+
+	matchers, err := usbMatchers()
+	if err != nil {
+		return nil, err
+	}
+
+	if *merge {
+		return func() (btk.InputSource, error) {
+			return btk.OpenMergedUsbKeyboards(matchers...)
+		}, nil
+	}
+
+	return func() (btk.InputSource, error) {
+		return btk.OpenUsbKeyboard(matchers...)
+	}, nil
+}
+
+// withMouse combines the keyboard with the first usb mouse, which may be
+// plugged and unplugged any time
+func withMouse(open opener) opener {
+	return func() (btk.InputSource, error) {
+		kb, err := open()
+		if err != nil {
+			return nil, err
+		}
+
+		mouse, err := btk.OpenOptionalUsbMouse()
+		if err != nil {
+			kb.Close()
+			return nil, err
+		}
+
+		src, err := btk.NewCompositeSource(kb, mouse)
+		if err != nil {
+			kb.Close()
+			mouse.Close()
+			return nil, err
+		}
+		return src, nil
+	}
+}
+
+func newKeyboard() (*btk.Keyboard, error) {
+	open, err := keyboardOpener()
+	if err != nil {
+		return nil, err
+	}
+
+	if *mouse {
+		open = withMouse(open)
+	}
+
+	return btk.NewKeyboardWithOpener(open)
+}
+
+// openReopeningEvdev opens the input device, which is opened again when it's
+// replugged, so the other merged devices keep working meanwhile
+func openReopeningEvdev(dev string) (btk.InputSource, error) {
+	open := func() (btk.InputSource, error) {
+		src, err := btk.OpenEvdev(dev)
+		if err != nil {
+			return nil, err
+		}
+		return src, nil
+	}
+
+	src, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	reopening, err := btk.NewReopeningSource(src.Desc(), src, open)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return reopening, nil
+}
+
+func openEvdev() (btk.InputSource, error) {
+	devs := strings.Split(*evdev, ",")
+	if len(devs) == 1 {
+		return btk.OpenEvdev(devs[0])
+	}
+
+	var sources []btk.InputSource
+	for _, dev := range devs {
+		src, err := openReopeningEvdev(dev)
+		if err != nil {
+			for _, s := range sources {
+				s.Close()
+			}
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+
+	src, err := btk.NewMergedSource(sources...)
+	if err != nil {
+		for _, s := range sources {
+			s.Close()
+		}
+		return nil, err
+	}
+	return src, nil
+}
+
 func main() {
+	flag.Parse()
+
+	if *list {
+		listDevices()
+		return
+	}
+
 	if os.Getenv("DEBUG") == "1" {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-	kb, err := btk.NewKeyboard()
+	kb, err := newKeyboard()
 	exitOnError("Failed to create keyboard", err)
 
 	hidp, err := btk.NewHidProfile("/red/potch/profile")
@@ -34,30 +377,30 @@ func main() {
 
 	exitOnError("Failed to export profile", hidp.Export())
 
-	exitOnError("Failed to register profile", hidp.Register(kb.Desc()))
+	exitOnError("Failed to register profile", hidp.Register(kb.Desc(), kb.SubClass()))
 
-	// make the device discoverable
-	exitOnError(
-		"Failed to set to piscan",
-		exec.Command("hciconfig", "hci0", "piscan").Run(),
-	)
+	agent, err := registerAgent(hidp, kb)
+	exitOnError("Failed to register pairing agent", err)
 
-	// set the device class to keyboard
-	exitOnError(
-		"Failed to set device class",
-		exec.Command("hciconfig", "hci0", "class", "02540").Run(),
-	)
+	// signals are caught before the adapter is changed, so it's always
+	// restored on exit
+	interrupt := userInterrupt()
+
+	adapter, err := setupAdapter(kb)
+	exitOnError("Failed to set up bluetooth adapter", err)
 
 	logrus.WithField("desc", kb.Desc()).Infoln("HID profile registered")
 
 	go kb.HandleHID()
 
+	unpair := userUnpair()
+
 Loop:
 	for {
 		select {
-		case sig := <-userInterrupt():
+		case sig := <-interrupt:
 			logrus.WithField("signal", sig.String()).
-				Warnln("Exiting on user interrupt")
+				Warnln("Exiting on signal")
 			kb.Stop()
 			break Loop
 		case client := <-hidp.Connection():
@@ -65,12 +408,31 @@ Loop:
 				client.Sctrl.Close()
 				client.Sintr.Close()
 			}
+		case <-unpair:
+			if err := kb.Unplug(); err != nil {
+				logrus.WithError(err).Warnln("Failed to unpair host")
+			}
+		case client := <-kb.Unplugs():
+			if err := hidp.RemoveDevice(client.Dev); err != nil {
+				logrus.WithError(err).WithField("client", client.Dev).
+					Warnln("Failed to remove unplugged host")
+			}
 			// case client := <-hidp.Disconnection():
 			// logrus.Warnln("disconnect")
 			// kb.Disconnect(client)
 		}
 	}
 
+	if err := adapter.Restore(); err != nil {
+		logrus.WithError(err).Warnln("Failed to restore bluetooth adapter")
+	}
+
+	if agent != nil {
+		if err := agent.Unregister(); err != nil {
+			logrus.WithError(err).Warnln("Failed to unregister pairing agent")
+		}
+	}
+
 	// Profile will be automatically unregistered by dbus
 	hidp.Close()
 }
@@ -0,0 +1,237 @@
+package btk
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// maxReportID is the largest report ID, 0 is reserved
+const maxReportID = 255
+
+// CompositeSource is an InputSource combining several sources into one HID
+// device with multiple report IDs, e.g. a keyboard, a mouse and media keys.
+// Report IDs are allocated from 1 in the order of the sources. A source
+// without report IDs gets one report ID, while a source with its own report
+// IDs gets each of them remapped to a new one. Input reports are tagged with
+// the new report ID of their source, and output reports from the host are
+// routed back to the source of the report ID.
+type CompositeSource struct {
+	in      *fanIn
+	entries []*compositeEntry
+	desc    []byte
+	// routes maps report IDs of the composite descriptor to the sources
+	routes map[uint8]compositeRoute
+}
+
+type compositeEntry struct {
+	src  InputSource
+	desc *reportDesc
+	// id is the report ID of a source without report IDs
+	id uint8
+	// ids maps report IDs of the source to report IDs of the composite
+	ids map[uint8]uint8
+}
+
+type compositeRoute struct {
+	entry *compositeEntry
+	// id is the report ID of the source, 0 if it has no report IDs
+	id uint8
+}
+
+// NewCompositeSource returns a CompositeSource on the given sources
+func NewCompositeSource(sources ...InputSource) (*CompositeSource, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no input source to combine")
+	}
+
+	s := &CompositeSource{routes: make(map[uint8]compositeRoute)}
+	next := 1
+
+	for _, src := range sources {
+		desc, err := parseDesc(src.Desc())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse HID descriptor")
+		}
+
+		e := &compositeEntry{src: src, desc: desc, ids: make(map[uint8]uint8)}
+
+		if !desc.ids {
+			if next > maxReportID {
+				return nil, errors.New("too many report IDs")
+			}
+			e.id = uint8(next)
+			s.routes[e.id] = compositeRoute{e, 0}
+			next++
+		} else {
+			for _, id := range desc.reportIDs() {
+				if next > maxReportID {
+					return nil, errors.New("too many report IDs")
+				}
+				e.ids[id] = uint8(next)
+				s.routes[uint8(next)] = compositeRoute{e, id}
+				next++
+			}
+		}
+
+		s.desc = append(s.desc, e.rewriteDesc(src.Desc())...)
+		s.entries = append(s.entries, e)
+	}
+
+	s.in = newFanIn(sources)
+
+	return s, nil
+}
+
+// rewriteDesc returns the descriptor of the source with report IDs of the
+// composite. For a source without report IDs, a report ID item is added at
+// the start of each top level collection, otherwise the data of all report
+// ID items are replaced.
+func (e *compositeEntry) rewriteDesc(desc []byte) []byte {
+	var out []byte
+	depth := 0
+
+	for i := 0; i < len(desc); {
+		n := itemLen(desc, i)
+		if i+n > len(desc) {
+			n = len(desc) - i
+		}
+
+		prefix := desc[i] &^ itemSizeMask
+
+		if prefix == itemReportID && desc[i] != itemLong && n > 1 {
+			out = append(out, itemReportID|1, e.ids[desc[i+1]])
+			i += n
+			continue
+		}
+
+		out = append(out, desc[i:i+n]...)
+
+		switch prefix {
+		case itemCollection:
+			if depth == 0 && e.id != 0 {
+				out = append(out, itemReportID|1, e.id)
+			}
+			depth++
+		case itemEndCollection:
+			depth--
+		}
+
+		i += n
+	}
+
+	return out
+}
+
+// toComposite returns a report of the source with the report ID of the
+// composite, it returns false if the report ID is unknown
+func (e *compositeEntry) toComposite(report []byte) ([]byte, bool) {
+	if e.id != 0 {
+		return append([]byte{e.id}, report...), true
+	}
+
+	if len(report) < 1 {
+		return nil, false
+	}
+
+	id, ok := e.ids[report[0]]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{id}, report[1:]...), true
+}
+
+// Desc returns the combined descriptor
+func (s *CompositeSource) Desc() []byte {
+	return s.desc
+}
+
+// ReadReport returns the next report of any source, with the report ID of the
+// composite. An error is returned as soon as any source is gone, so all of
+// them are opened again, sources which should be replugged on their own, e.g.
+// a mouse, are to be wrapped in ReopeningSource.
+func (s *CompositeSource) ReadReport() ([]byte, error) {
+	for {
+		i, report, gone, err := s.in.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if gone != nil {
+			return nil, errors.Wrap(gone, "input source gone")
+		}
+
+		e := s.entries[i]
+
+		r, ok := e.toComposite(report)
+		if !ok {
+			logrus.WithField("report", report).Debugln("Report of unknown ID dropped")
+			continue
+		}
+		return r, nil
+	}
+}
+
+// route returns the source of a report with the report ID of the composite,
+// and the report with the report ID of the source
+func (s *CompositeSource) route(report []byte) (InputSource, []byte, error) {
+	if len(report) < 1 {
+		return nil, nil, errors.New("empty report")
+	}
+
+	r, ok := s.routes[report[0]]
+	if !ok {
+		return nil, nil, errInvalidReportID
+	}
+
+	if r.entry.id != 0 {
+		return r.entry.src, report[1:], nil
+	}
+	return r.entry.src, append([]byte{r.id}, report[1:]...), nil
+}
+
+// WriteReport sends an output report to the source of its report ID
+func (s *CompositeSource) WriteReport(report []byte) error {
+	src, report, err := s.route(report)
+	if err != nil {
+		return err
+	}
+
+	if sink, ok := src.(OutputSink); ok {
+		return sink.WriteReport(report)
+	}
+	return nil
+}
+
+// SetFeature sends a feature report to the source of its report ID
+func (s *CompositeSource) SetFeature(report []byte) error {
+	src, report, err := s.route(report)
+	if err != nil {
+		return err
+	}
+	return setFeature(src, report)
+}
+
+// GetFeature reads the feature report with the given report ID of the
+// composite from its source
+func (s *CompositeSource) GetFeature(id uint8) ([]byte, error) {
+	r, ok := s.routes[id]
+	if !ok {
+		return nil, errInvalidReportID
+	}
+
+	report, err := getFeature(r.entry.src, r.id)
+	if err != nil {
+		return nil, err
+	}
+
+	if report, ok = r.entry.toComposite(report); !ok {
+		return nil, errInvalidReportID
+	}
+	return report, nil
+}
+
+// Close closes all the sources
+func (s *CompositeSource) Close() error {
+	s.in.close()
+	return nil
+}
@@ -0,0 +1,226 @@
+package btk
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// idKeyboardDesc is a boot keyboard with report ID 1
+var idKeyboardDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xa1, 0x01, // Collection (Application)
+	0x85, 0x01, //   Report ID (1)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0xe0, //   Usage Minimum (Left Control)
+	0x29, 0xe7, //   Usage Maximum (Right GUI)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Variable, Absolute)
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x08, //   Report Size (8)
+	0x81, 0x01, //   Input (Constant)
+	0x95, 0x05, //   Report Count (5)
+	0x75, 0x01, //   Report Size (1)
+	0x05, 0x08, //   Usage Page (LEDs)
+	0x19, 0x01, //   Usage Minimum (Num Lock)
+	0x29, 0x05, //   Usage Maximum (Kana)
+	0x91, 0x02, //   Output (Data, Variable, Absolute)
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x03, //   Report Size (3)
+	0x91, 0x01, //   Output (Constant)
+	0x95, 0x06, //   Report Count (6)
+	0x75, 0x08, //   Report Size (8)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x65, //   Logical Maximum (101)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, 0x65, //   Usage Maximum (101)
+	0x81, 0x00, //   Input (Data, Array)
+	0xc0, // End Collection
+}
+
+// idConsumerDesc is a consumer control with report ID 1, and a backlight
+// level as feature report 2
+var idConsumerDesc = []byte{
+	0x05, 0x0c, // Usage Page (Consumer)
+	0x09, 0x01, // Usage (Consumer Control)
+	0xa1, 0x01, // Collection (Application)
+	0x85, 0x01, //   Report ID (1)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x03, //   Logical Maximum (1023)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x2a, 0xff, 0x03, //   Usage Maximum (1023)
+	0x75, 0x10, //   Report Size (16)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x00, //   Input (Data, Array)
+	0x85, 0x02, //   Report ID (2)
+	0x06, 0x00, 0xff, //   Usage Page (Vendor Defined)
+	0x09, 0x01, //   Usage (1)
+	0x26, 0xff, 0x00, //   Logical Maximum (255)
+	0x75, 0x08, //   Report Size (8)
+	0xb1, 0x02, //   Feature (Data, Variable, Absolute)
+	0xc0, // End Collection
+}
+
+// featureSource is a MemorySource which keeps the feature reports it's sent
+type featureSource struct {
+	*MemorySource
+	features map[uint8][]byte
+}
+
+func newFeatureSource(desc []byte) *featureSource {
+	return &featureSource{NewMemorySource(desc), make(map[uint8][]byte)}
+}
+
+func (s *featureSource) SetFeature(report []byte) error {
+	s.features[report[0]] = append([]byte(nil), report...)
+	return nil
+}
+
+func (s *featureSource) GetFeature(id uint8) ([]byte, error) {
+	r, ok := s.features[id]
+	if !ok {
+		return nil, errInvalidReportID
+	}
+	return r, nil
+}
+
+func readReport(t *testing.T, src InputSource) []byte {
+	t.Helper()
+
+	ch := make(chan []byte, 1)
+	go func() {
+		r, err := src.ReadReport()
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- r
+	}()
+
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report")
+	}
+	return nil
+}
+
+func TestCompositeSourceRemapsReportIDs(t *testing.T) {
+	kb := NewMemorySource(idKeyboardDesc)
+	media := newFeatureSource(idConsumerDesc)
+
+	s, err := NewCompositeSource(kb, media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the report IDs of the keyboard are taken first, those of the media
+	// keys follow
+	want := append([]byte(nil), idKeyboardDesc...)
+	want = append(want, idConsumerDesc...)
+	want[len(idKeyboardDesc)+7] = 2
+	want[len(idKeyboardDesc)+25] = 3
+	if !bytes.Equal(s.Desc(), want) {
+		t.Errorf("descriptor is %x, want %x", s.Desc(), want)
+	}
+
+	go kb.Send(append([]byte{1}, bootKeys(0x04)...))
+	if r, want := readReport(t, s), append([]byte{1}, bootKeys(0x04)...); !bytes.Equal(r, want) {
+		t.Errorf("keyboard report is %x, want %x", r, want)
+	}
+
+	go media.Send([]byte{1, 0xe9, 0x00})
+	if r, want := readReport(t, s), []byte{2, 0xe9, 0x00}; !bytes.Equal(r, want) {
+		t.Errorf("media report is %x, want %x", r, want)
+	}
+
+	// output reports go back to their source with its own report ID
+	if err := s.WriteReport([]byte{1, 0x02}); err != nil {
+		t.Fatal(err)
+	}
+	if out := kb.Outputs(); len(out) != 1 || !bytes.Equal(out[0], []byte{1, 0x02}) {
+		t.Errorf("keyboard outputs are %x, want [0102]", out)
+	}
+	if out := media.Outputs(); len(out) != 0 {
+		t.Errorf("media outputs are %x, want none", out)
+	}
+
+	if err := s.WriteReport([]byte{4, 0x00}); err != errInvalidReportID {
+		t.Errorf("output report of unknown ID returned %v", err)
+	}
+
+	// so do feature reports, and they are read back with the composite ID
+	if err := s.SetFeature([]byte{3, 0x80}); err != nil {
+		t.Fatal(err)
+	}
+	if r, want := media.features[2], []byte{2, 0x80}; !bytes.Equal(r, want) {
+		t.Errorf("media feature is %x, want %x", r, want)
+	}
+	if r, err := s.GetFeature(3); err != nil || !bytes.Equal(r, []byte{3, 0x80}) {
+		t.Errorf("GetFeature(3) = %x, %v", r, err)
+	}
+	if _, err := s.GetFeature(1); err != errUnsupported {
+		t.Errorf("feature report of the keyboard returned %v", err)
+	}
+	if _, err := s.GetFeature(4); err != errInvalidReportID {
+		t.Errorf("feature report of unknown ID returned %v", err)
+	}
+}
+
+func TestCompositeSourceOptionalMouse(t *testing.T) {
+	kb := NewMemorySource(bootKeyboardDesc)
+	plugged := make(chan InputSource, 1)
+
+	mouse, err := NewReopeningSource(bootMouseDesc, nil, func() (InputSource, error) {
+		select {
+		case src := <-plugged:
+			return src, nil
+		default:
+			return nil, errSourceAbsent
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewCompositeSource(kb, mouse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	go kb.Send(bootKeys(0x04))
+	if r := readReport(t, s); !bytes.Equal(r, append([]byte{1}, bootKeys(0x04)...)) {
+		t.Fatalf("report is %v, want a pressed on report ID 1", r)
+	}
+
+	m := NewMemorySource(bootMouseDesc)
+	plugged <- m
+	go m.Send([]byte{0x01, 0, 0, 0})
+	if r := readReport(t, s); !bytes.Equal(r, []byte{2, 0x01, 0, 0, 0}) {
+		t.Fatalf("report is %v, want the left button on report ID 2", r)
+	}
+
+	// unplugging the mouse releases its buttons, the keyboard keeps going
+	m.Close()
+	if r := readReport(t, s); !bytes.Equal(r, []byte{2, 0, 0, 0, 0}) {
+		t.Fatalf("report is %v, want the buttons released", r)
+	}
+
+	go kb.Send(bootKeys())
+	if r := readReport(t, s); !bytes.Equal(r, append([]byte{1}, bootKeys()...)) {
+		t.Fatalf("report is %v, want the keys released", r)
+	}
+
+	// the keyboard is required
+	kb.Close()
+	if _, err := s.ReadReport(); err == nil {
+		t.Fatal("no error when the keyboard is gone")
+	}
+}
@@ -0,0 +1,571 @@
+package btk
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Usage pages used by btk
+const (
+	pageGenericDesktop = 0x01
+	pageKeyboard       = 0x07
+	pageLED            = 0x08
+	pageButton         = 0x09
+	pageConsumer       = 0x0c
+)
+
+// Report types, which are also the tags of the main items
+const (
+	reportInput   = 0x80
+	reportOutput  = 0x90
+	reportFeature = 0xb0
+)
+
+// Item prefixes with the size bits cleared
+const (
+	itemSizeMask = 0x03
+	itemLong     = 0xfe
+
+	itemCollection    = 0xa0
+	itemEndCollection = 0xc0
+
+	itemUsagePage   = 0x04
+	itemLogicalMin  = 0x14
+	itemLogicalMax  = 0x24
+	itemReportSize  = 0x74
+	itemReportID    = 0x84
+	itemReportCount = 0x94
+	itemPush        = 0xa4
+	itemPop         = 0xb4
+
+	itemUsage    = 0x08
+	itemUsageMin = 0x18
+	itemUsageMax = 0x28
+)
+
+// Main item flags
+const (
+	flagConstant = 1 << 0
+	flagVariable = 1 << 1
+)
+
+// descItem is a short item in a HID report descriptor
+type descItem struct {
+	// prefix is the item prefix with the size bits cleared, i.e. tag and type
+	prefix uint8
+	data   []byte
+}
+
+// value returns the item data as an unsigned integer
+func (it descItem) value() uint32 {
+	var v uint32
+	for i, b := range it.data {
+		v |= uint32(b) << (8 * uint(i))
+	}
+	return v
+}
+
+// signed returns the item data as a signed integer
+func (it descItem) signed() int32 {
+	v := it.value()
+	switch len(it.data) {
+	case 1:
+		return int32(int8(v))
+	case 2:
+		return int32(int16(v))
+	}
+	return int32(v)
+}
+
+// descItems returns the short items in the HID report descriptor, long items
+// are skipped since they are not used by any known device
+func descItems(desc []byte) []descItem {
+	var items []descItem
+
+	for i := 0; i < len(desc); {
+		n := itemLen(desc, i)
+		if i+n > len(desc) {
+			break
+		}
+
+		if desc[i] != itemLong {
+			items = append(items, descItem{
+				prefix: desc[i] &^ itemSizeMask,
+				data:   desc[i+1 : i+n],
+			})
+		}
+		i += n
+	}
+
+	return items
+}
+
+// itemLen returns the length of the item at offset i of the descriptor
+func itemLen(desc []byte, i int) int {
+	if desc[i] == itemLong {
+		if i+1 >= len(desc) {
+			return 1
+		}
+		return 3 + int(desc[i+1])
+	}
+
+	size := int(desc[i] & itemSizeMask)
+	if size == 3 {
+		size = 4
+	}
+	return 1 + size
+}
+
+// hasReportIDs tells if reports of the descriptor are prefixed by report IDs
+func hasReportIDs(desc []byte) bool {
+	for _, it := range descItems(desc) {
+		if it.prefix == itemReportID {
+			return true
+		}
+	}
+	return false
+}
+
+// usage is an extended usage, i.e. usage page in the high 16 bits and usage
+// ID in the low 16 bits
+type usage uint32
+
+func makeUsage(page, id uint16) usage {
+	return usage(page)<<16 | usage(id)
+}
+
+func (u usage) page() uint16 {
+	return uint16(u >> 16)
+}
+
+func (u usage) id() uint16 {
+	return uint16(u)
+}
+
+// reportField is a main item of a report, i.e. Input, Output or Feature
+type reportField struct {
+	typ      uint8
+	reportID uint8
+	flags    uint32
+
+	// offset is the bit offset in the report, not counting the report ID
+	offset int
+	size   int
+	count  int
+
+	logicalMin int32
+	logicalMax int32
+
+	usages   []usage
+	usageMin usage
+	usageMax usage
+}
+
+func (f *reportField) isVariable() bool {
+	return f.flags&flagVariable != 0
+}
+
+func (f *reportField) isConstant() bool {
+	return f.flags&flagConstant != 0
+}
+
+// usage returns the usage of the i-th element of a variable field, or the
+// usage of array index i of an array field
+func (f *reportField) usage(i int) (usage, bool) {
+	if len(f.usages) > 0 {
+		if i >= len(f.usages) {
+			if f.isVariable() {
+				// the last usage applies to the remaining elements
+				return f.usages[len(f.usages)-1], true
+			}
+			return 0, false
+		}
+		return f.usages[i], true
+	}
+
+	if f.usageMin == 0 && f.usageMax == 0 {
+		return 0, false
+	}
+
+	u := f.usageMin + usage(i)
+	if u > f.usageMax {
+		return 0, false
+	}
+	return u, true
+}
+
+// hasUsagePage tells if any usage of the field is on the given page
+func (f *reportField) hasUsagePage(page uint16) bool {
+	for _, u := range f.usages {
+		if u.page() == page {
+			return true
+		}
+	}
+	return f.usageMin.page() == page && (f.usageMin != 0 || f.usageMax != 0)
+}
+
+// hasUsage tells if the field has the given usage
+func (f *reportField) hasUsage(u usage) bool {
+	for _, fu := range f.usages {
+		if fu == u {
+			return true
+		}
+	}
+	return f.usageMin != 0 && u >= f.usageMin && u <= f.usageMax
+}
+
+// reportDesc is a parsed HID report descriptor
+type reportDesc struct {
+	fields []*reportField
+	// ids tells if reports are prefixed by report IDs
+	ids bool
+	// sizes are the sizes in bits of reports, keyed by report type and ID
+	sizes map[[2]uint8]int
+}
+
+type globalState struct {
+	usagePage  uint16
+	logicalMin int32
+	logicalMax int32
+	size       int
+	count      int
+	reportID   uint8
+}
+
+// parseDesc parses a HID report descriptor
+func parseDesc(desc []byte) (*reportDesc, error) {
+	d := &reportDesc{sizes: make(map[[2]uint8]int)}
+
+	var global globalState
+	var stack []globalState
+	var local reportField
+	depth := 0
+
+	for _, it := range descItems(desc) {
+		switch it.prefix {
+		case itemUsagePage:
+			global.usagePage = uint16(it.value())
+		case itemLogicalMin:
+			global.logicalMin = it.signed()
+		case itemLogicalMax:
+			// the maximum is unsigned unless the minimum is negative, as
+			// Linux does, e.g. 0x25 0xff is 255 for key arrays
+			if global.logicalMin < 0 {
+				global.logicalMax = it.signed()
+			} else {
+				global.logicalMax = int32(it.value())
+			}
+		case itemReportSize:
+			global.size = int(it.value())
+		case itemReportCount:
+			global.count = int(it.value())
+		case itemReportID:
+			global.reportID = uint8(it.value())
+			d.ids = true
+		case itemPush:
+			stack = append(stack, global)
+		case itemPop:
+			if len(stack) == 0 {
+				return nil, errors.New("pop without push in HID descriptor")
+			}
+			global = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+		case itemUsage:
+			local.usages = append(local.usages, global.extend(it))
+		case itemUsageMin:
+			local.usageMin = global.extend(it)
+		case itemUsageMax:
+			local.usageMax = global.extend(it)
+
+		case itemCollection:
+			depth++
+			local = reportField{}
+		case itemEndCollection:
+			if depth == 0 {
+				return nil, errors.New("unbalanced collection in HID descriptor")
+			}
+			depth--
+			local = reportField{}
+
+		case reportInput, reportOutput, reportFeature:
+			typ := it.prefix
+			key := [2]uint8{typ, global.reportID}
+
+			f := local
+			f.typ = typ
+			f.reportID = global.reportID
+			f.flags = it.value()
+			f.offset = d.sizes[key]
+			f.size = global.size
+			f.count = global.count
+			f.logicalMin = global.logicalMin
+			f.logicalMax = global.logicalMax
+
+			d.sizes[key] += f.size * f.count
+			d.fields = append(d.fields, &f)
+			local = reportField{}
+		}
+	}
+
+	if depth != 0 {
+		return nil, errors.New("unbalanced collection in HID descriptor")
+	}
+
+	return d, nil
+}
+
+// extend returns the extended usage of a usage item
+func (g *globalState) extend(it descItem) usage {
+	if len(it.data) == 4 {
+		return usage(it.value())
+	}
+	return makeUsage(g.usagePage, uint16(it.value()))
+}
+
+// reportIDs returns all report IDs in the descriptor in the order they appear
+func (d *reportDesc) reportIDs() []uint8 {
+	var ids []uint8
+	seen := map[uint8]bool{}
+	for _, f := range d.fields {
+		if !seen[f.reportID] {
+			seen[f.reportID] = true
+			ids = append(ids, f.reportID)
+		}
+	}
+	return ids
+}
+
+// reportIDsOf returns the IDs of reports of the given type
+func (d *reportDesc) reportIDsOf(typ uint8) []uint8 {
+	var ids []uint8
+	seen := map[uint8]bool{}
+	for _, f := range d.fields {
+		if f.typ == typ && !seen[f.reportID] {
+			seen[f.reportID] = true
+			ids = append(ids, f.reportID)
+		}
+	}
+	return ids
+}
+
+// reportSize returns the size in bytes of the report of the given type and
+// ID, not counting the report ID
+func (d *reportDesc) reportSize(typ, id uint8) int {
+	return (d.sizes[[2]uint8{typ, id}] + 7) / 8
+}
+
+// reportPayload splits a report into its report ID and data
+func (d *reportDesc) reportPayload(report []byte) (uint8, []byte) {
+	if !d.ids {
+		return 0, report
+	}
+	if len(report) == 0 {
+		return 0, nil
+	}
+	return report[0], report[1:]
+}
+
+// usageValue is the value of a usage in a report
+type usageValue struct {
+	usage usage
+	value int32
+}
+
+// values decodes a report of the given type into usage values. For variable
+// fields every usage is returned, while for array fields only the usages
+// present in the array are returned with the value 1.
+func (d *reportDesc) values(typ uint8, report []byte) []usageValue {
+	id, data := d.reportPayload(report)
+
+	var values []usageValue
+	for _, f := range d.fields {
+		if f.typ != typ || f.reportID != id || f.isConstant() {
+			continue
+		}
+
+		for i := 0; i < f.count; i++ {
+			raw, ok := readBits(data, f.offset+i*f.size, f.size)
+			if !ok {
+				break
+			}
+
+			if f.isVariable() {
+				u, ok := f.usage(i)
+				if !ok {
+					continue
+				}
+				values = append(values, usageValue{u, f.decode(raw)})
+				continue
+			}
+
+			idx := f.decode(raw)
+			if idx < f.logicalMin || idx > f.logicalMax {
+				continue
+			}
+			u, ok := f.usage(int(idx - f.logicalMin))
+			if !ok || u.id() == 0 {
+				continue
+			}
+			values = append(values, usageValue{u, 1})
+		}
+	}
+
+	return values
+}
+
+// decode sign extends the raw value if the logical minimum is negative
+func (f *reportField) decode(raw uint32) int32 {
+	if f.logicalMin < 0 && f.size < 32 && raw&(1<<uint(f.size-1)) != 0 {
+		return int32(raw | ^uint32(0)<<uint(f.size))
+	}
+	return int32(raw)
+}
+
+// encode builds a report of the given type and ID from usage values, usages
+// which are not in the report are ignored. The report is prefixed by the
+// report ID if the descriptor has report IDs.
+func (d *reportDesc) encode(typ, id uint8, values []usageValue) []byte {
+	data := make([]byte, d.reportSize(typ, id))
+
+	for _, f := range d.fields {
+		if f.typ != typ || f.reportID != id || f.isConstant() {
+			continue
+		}
+
+		if f.isVariable() {
+			for i := 0; i < f.count; i++ {
+				u, ok := f.usage(i)
+				if !ok {
+					continue
+				}
+				for _, v := range values {
+					if v.usage == u {
+						writeBits(data, f.offset+i*f.size, f.size, uint32(f.clamp(v.value)))
+						break
+					}
+				}
+			}
+			continue
+		}
+
+		slot := 0
+		for _, v := range values {
+			if slot >= f.count || v.value == 0 {
+				continue
+			}
+			idx, ok := f.index(v.usage)
+			if !ok {
+				continue
+			}
+			writeBits(data, f.offset+slot*f.size, f.size, uint32(idx))
+			slot++
+		}
+	}
+
+	if d.ids {
+		return append([]byte{id}, data...)
+	}
+	return data
+}
+
+// clamp limits the value in the logical range of the field
+func (f *reportField) clamp(v int32) int32 {
+	if f.logicalMin < f.logicalMax {
+		if v < f.logicalMin {
+			return f.logicalMin
+		}
+		if v > f.logicalMax {
+			return f.logicalMax
+		}
+	}
+	return v
+}
+
+// index returns the array index of the usage in an array field
+func (f *reportField) index(u usage) (int32, bool) {
+	if len(f.usages) > 0 {
+		for i, fu := range f.usages {
+			if fu == u {
+				return f.logicalMin + int32(i), true
+			}
+		}
+		return 0, false
+	}
+
+	if f.usageMin == 0 && f.usageMax == 0 || u < f.usageMin || u > f.usageMax {
+		return 0, false
+	}
+
+	idx := f.logicalMin + int32(u-f.usageMin)
+	if idx > f.logicalMax {
+		return 0, false
+	}
+	return idx, true
+}
+
+// findReport returns the ID of the first report of the given type which has
+// any usage on the page
+func (d *reportDesc) findReport(typ uint8, page uint16) (uint8, bool) {
+	for _, f := range d.fields {
+		if f.typ == typ && !f.isConstant() && f.hasUsagePage(page) {
+			return f.reportID, true
+		}
+	}
+	return 0, false
+}
+
+// readBits reads size bits at the bit offset of data in little endian
+func readBits(data []byte, offset, size int) (uint32, bool) {
+	if size <= 0 || size > 32 || offset+size > len(data)*8 {
+		return 0, false
+	}
+
+	var v uint32
+	for i := 0; i < size; i++ {
+		bit := offset + i
+		if data[bit/8]&(1<<uint(bit%8)) != 0 {
+			v |= 1 << uint(i)
+		}
+	}
+	return v, true
+}
+
+// writeBits writes size bits of v at the bit offset of data in little endian
+func writeBits(data []byte, offset, size int, v uint32) {
+	if size <= 0 || size > 32 || offset+size > len(data)*8 {
+		return
+	}
+
+	for i := 0; i < size; i++ {
+		bit := offset + i
+		if v&(1<<uint(i)) != 0 {
+			data[bit/8] |= 1 << uint(bit%8)
+		} else {
+			data[bit/8] &^= 1 << uint(bit%8)
+		}
+	}
+}
+
+// SDP HIDDeviceSubclass, i.e. the minor device class of a peripheral
+const (
+	subClassKeyboard = 0x40
+	subClassPointing = 0x80
+)
+
+// subClass returns the HIDDeviceSubclass of the device the descriptor
+// describes, i.e. whether it's a keyboard, a pointing device or both
+func subClass(desc []byte) uint8 {
+	d, err := parseDesc(desc)
+	if err != nil {
+		return subClassKeyboard
+	}
+
+	var c uint8
+	if _, ok := d.findReport(reportInput, pageKeyboard); ok {
+		c |= subClassKeyboard
+	}
+	if isPointer(d) {
+		c |= subClassPointing
+	}
+	return c
+}
@@ -0,0 +1,45 @@
+package btk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDescUnsignedLogicalMax(t *testing.T) {
+	desc := []byte{
+		0x05, 0x01, // Usage Page (Generic Desktop)
+		0x09, 0x06, // Usage (Keyboard)
+		0xa1, 0x01, // Collection (Application)
+		0x05, 0x07, //   Usage Page (Keyboard)
+		0x95, 0x02, //   Report Count (2)
+		0x75, 0x08, //   Report Size (8)
+		0x15, 0x00, //   Logical Minimum (0)
+		0x25, 0xff, //   Logical Maximum (255)
+		0x19, 0x00, //   Usage Minimum (0)
+		0x29, 0xff, //   Usage Maximum (255)
+		0x81, 0x00, //   Input (Data, Array)
+		0x15, 0x81, //   Logical Minimum (-127)
+		0x25, 0xff, //   Logical Maximum (-1)
+		0x95, 0x01, //   Report Count (1)
+		0x09, 0x30, //   Usage (0x30)
+		0x81, 0x02, //   Input (Data, Variable, Absolute)
+		0xc0, // End Collection
+	}
+
+	d, err := parseDesc(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if max := d.fields[0].logicalMax; max != 255 {
+		t.Errorf("logical maximum of the key array is %d, want 255", max)
+	}
+	if max := d.fields[1].logicalMax; max != -1 {
+		t.Errorf("logical maximum after a negative minimum is %d, want -1", max)
+	}
+
+	keys, ok := pressedKeys(d, []byte{0x04, 0xe0, 0x00})
+	if !ok || !reflect.DeepEqual(keys, []uint8{0x04, 0xe0}) {
+		t.Errorf("pressed keys are %v, want [4 224]", keys)
+	}
+}
@@ -0,0 +1,301 @@
+package btk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	evSyn = 0x00
+	evKey = 0x01
+	evLed = 0x11
+
+	synReport  = 0
+	synDropped = 3
+
+	keyMax = 0x2ff
+	ledMax = 0x04
+
+	evdevDir   = "/dev/input"
+	evdevByID  = "/dev/input/by-id"
+	evdevGlob  = "/dev/input/event*"
+	evdevNames = 256
+)
+
+// ioctl request numbers, see linux/input.h
+var (
+	eviocgrab  = ioc(iocWrite, 'E', 0x90, 4)
+	eviocgname = ioc(iocRead, 'E', 0x06, evdevNames)
+	eviocgkey  = ioc(iocRead, 'E', 0x18, keyMax/8+1)
+)
+
+// inputEvent is struct input_event in linux/input.h
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// usbKeycodes maps HID keyboard usages to linux keycodes, it's the same table
+// as usb_kbd_keycode in drivers/hid/usbhid/usbkbd.c
+var usbKeycodes = [...]uint16{
+	0, 0, 0, 0, 30, 48, 46, 32, 18, 33, 34, 35, 23, 36, 37, 38,
+	50, 49, 24, 25, 16, 19, 31, 20, 22, 47, 17, 45, 21, 44, 2, 3,
+	4, 5, 6, 7, 8, 9, 10, 11, 28, 1, 14, 15, 57, 12, 13, 26,
+	27, 43, 43, 39, 40, 41, 51, 52, 53, 58, 59, 60, 61, 62, 63, 64,
+	65, 66, 67, 68, 87, 88, 99, 70, 119, 110, 102, 104, 111, 107, 109, 106,
+	105, 108, 103, 69, 98, 55, 74, 78, 96, 79, 80, 81, 75, 76, 77, 71,
+	72, 73, 82, 83, 86, 127, 116, 117, 183, 184, 185, 186, 187, 188, 189, 190,
+	191, 192, 193, 194, 134, 138, 130, 132, 128, 129, 131, 137, 133, 135, 136, 113,
+	115, 114, 0, 0, 0, 121, 0, 89, 93, 124, 92, 94, 95, 0, 0, 0,
+	122, 123, 90, 91, 85, 0, 0, 0, 0, 0, 0, 0, 111, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	29, 42, 56, 125, 97, 54, 100, 126,
+}
+
+// keycodeUsages is the reverse of usbKeycodes
+var keycodeUsages = map[uint16]uint8{}
+
+func init() {
+	for usage, code := range usbKeycodes {
+		if _, ok := keycodeUsages[code]; code != 0 && !ok {
+			keycodeUsages[code] = uint8(usage)
+		}
+	}
+}
+
+// EvdevSource is an InputSource on a linux input device, i.e.
+// /dev/input/eventN. Key events are translated to boot keyboard reports, so
+// it works for any keyboard the kernel knows about, no matter how it's
+// connected.
+type EvdevSource struct {
+	r    io.ReadCloser
+	name string
+
+	done chan struct{}
+	once sync.Once
+
+	mu    sync.Mutex
+	state keyState
+}
+
+// NewEvdevSource returns an EvdevSource reading input events from r. r is
+// usually an opened input device, but can be any stream of input events.
+func NewEvdevSource(r io.ReadCloser) *EvdevSource {
+	return &EvdevSource{r: r, done: make(chan struct{})}
+}
+
+// OpenEvdev opens and grabs the given input device, so its key events are
+// not seen by anyone else while in use. The device can be given as a path
+// e.g. /dev/input/event0, a symlink in /dev/input/by-id, or the device name
+// reported by the kernel.
+func OpenEvdev(dev string) (*EvdevSource, error) {
+	path, err := findEvdev(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open input device")
+	}
+
+	if err := fileIoctlInt(f, eviocgrab, 1); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to grab input device")
+	}
+
+	name, _ := evdevName(f)
+	logrus.WithField("path", path).WithField("name", name).
+		Debugln("Input device opened")
+
+	src := NewEvdevSource(f)
+	src.name = name
+	return src, nil
+}
+
+func findEvdev(dev string) (string, error) {
+	if strings.Contains(dev, "/") {
+		return dev, nil
+	}
+
+	if _, err := os.Stat(filepath.Join(evdevByID, dev)); err == nil {
+		return filepath.Join(evdevByID, dev), nil
+	}
+
+	if _, err := os.Stat(filepath.Join(evdevDir, dev)); err == nil {
+		return filepath.Join(evdevDir, dev), nil
+	}
+
+	paths, _ := filepath.Glob(evdevGlob)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		name, err := evdevName(f)
+		f.Close()
+		if err == nil && name == dev {
+			return path, nil
+		}
+	}
+
+	return "", errors.Errorf("input device %q not found", dev)
+}
+
+func evdevName(f *os.File) (string, error) {
+	buf := make([]byte, evdevNames)
+	if err := fileIoctl(f, eviocgname, unsafe.Pointer(&buf[0])); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(buf, "\x00")), nil
+}
+
+// Name returns the name of the input device, it's empty if the source is not
+// opened by OpenEvdev
+func (s *EvdevSource) Name() string {
+	return s.name
+}
+
+// Desc returns the descriptor of a boot keyboard
+func (s *EvdevSource) Desc() []byte {
+	return bootKeyboardDesc
+}
+
+// ReadReport reads input events until the key state changes, and returns the
+// new state as a boot keyboard report
+func (s *EvdevSource) ReadReport() ([]byte, error) {
+	changed, dropped := false, false
+
+	for {
+		var ev inputEvent
+		if err := binary.Read(s.r, binary.LittleEndian, &ev); err != nil {
+			select {
+			case <-s.done:
+				return nil, ErrSourceClosed
+			default:
+			}
+			return nil, err
+		}
+
+		switch ev.Type {
+		case evSyn:
+			switch ev.Code {
+			case synDropped:
+				// Events until the next SYN_REPORT are incomplete
+				dropped = true
+			case synReport:
+				if dropped {
+					dropped = false
+					changed = s.resync() || changed
+				}
+				if changed {
+					return s.report(), nil
+				}
+			}
+		case evKey:
+			if dropped || ev.Value == 2 {
+				// ignore auto repeat, the host does its own
+				continue
+			}
+			if s.handleKey(ev.Code, ev.Value != 0) {
+				changed = true
+			}
+		}
+	}
+}
+
+func (s *EvdevSource) handleKey(code uint16, pressed bool) bool {
+	usage, ok := keycodeUsages[code]
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pressed {
+		s.state.press(usage)
+	} else {
+		s.state.release(usage)
+	}
+	return true
+}
+
+// resync reloads the pressed keys from the device after events are dropped
+func (s *EvdevSource) resync() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.reset()
+
+	f, ok := s.r.(*os.File)
+	if !ok {
+		return true
+	}
+
+	bits := make([]byte, keyMax/8+1)
+	if err := fileIoctl(f, eviocgkey, unsafe.Pointer(&bits[0])); err != nil {
+		logrus.WithError(err).Warnln("Failed to get key state of input device")
+		return true
+	}
+
+	for code, usage := range keycodeUsages {
+		if bits[code/8]&(1<<(code%8)) != 0 {
+			s.state.press(usage)
+		}
+	}
+	return true
+}
+
+func (s *EvdevSource) report() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.bootReport()
+}
+
+// WriteReport sets the keyboard LEDs from a boot keyboard output report
+func (s *EvdevSource) WriteReport(report []byte) error {
+	w, ok := s.r.(io.Writer)
+	if !ok || len(report) < 1 {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	// LED usages 1 to 5 are the same as linux LED codes 0 to 4
+	for i := uint16(0); i <= ledMax; i++ {
+		binary.Write(buf, binary.LittleEndian, &inputEvent{
+			Type:  evLed,
+			Code:  i,
+			Value: int32(report[0]>>i) & 1,
+		})
+	}
+	binary.Write(buf, binary.LittleEndian, &inputEvent{Type: evSyn, Code: synReport})
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Close releases the input device
+func (s *EvdevSource) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.r.Close()
+	})
+	return err
+}
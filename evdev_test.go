@@ -0,0 +1,72 @@
+package btk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// evdevStream builds a stream of input events
+type evdevStream struct {
+	bytes.Buffer
+}
+
+func (s *evdevStream) event(typ, code uint16, value int32) *evdevStream {
+	binary.Write(&s.Buffer, binary.LittleEndian, &inputEvent{Type: typ, Code: code, Value: value})
+	return s
+}
+
+func (s *evdevStream) key(code uint16, value int32) *evdevStream {
+	return s.event(evKey, code, value)
+}
+
+func (s *evdevStream) syn() *evdevStream {
+	return s.event(evSyn, synReport, 0)
+}
+
+const (
+	keyA        = 30
+	keyB        = 48
+	keyLeftCtrl = 29
+)
+
+func TestEvdevSource(t *testing.T) {
+	var s evdevStream
+	s.key(keyA, 1).syn()
+	// auto repeat doesn't change anything
+	s.key(keyA, 2).syn()
+	s.key(keyLeftCtrl, 1).key(keyB, 1).syn()
+	s.key(keyA, 0).syn()
+	// keys are lost while events are dropped, all of them are released
+	// as the key state can't be read from a stream
+	s.event(evSyn, synDropped, 0).key(keyA, 1).syn()
+	// seven keys don't fit in a boot report
+	for code := uint16(2); code <= 8; code++ {
+		s.key(code, 1)
+	}
+	s.syn()
+
+	src := NewEvdevSource(ioutil.NopCloser(&s.Buffer))
+
+	for _, want := range [][]byte{
+		{0, 0, 0x04, 0, 0, 0, 0, 0},
+		{0x01, 0, 0x04, 0x05, 0, 0, 0, 0},
+		{0x01, 0, 0x05, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 0},
+		{0, 0, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01},
+	} {
+		r, err := src.ReadReport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(r, want) {
+			t.Errorf("report is %v, want %v", r, want)
+		}
+	}
+
+	if _, err := src.ReadReport(); err != io.EOF {
+		t.Errorf("error at the end of the stream is %v, want EOF", err)
+	}
+}
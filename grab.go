@@ -0,0 +1,125 @@
+package btk
+
+import (
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// keyGrabBuffer is how many key presses can be pending for a grab before
+// they're dropped
+const keyGrabBuffer = 32
+
+var errInputGrabbed = errors.New("keyboard input already taken")
+
+// keyPress is a key pressed on the keyboard while the input is grabbed,
+// along with all the keys held, including modifiers
+type keyPress struct {
+	usage uint8
+	held  map[uint8]bool
+}
+
+// keyGrab takes the input of the keyboard instead of the client, e.g. to
+// type a passkey. Keys of all report IDs are decoded into key presses.
+type keyGrab struct {
+	desc    *reportDesc
+	held    heldKeys
+	pressed map[uint8]bool
+
+	presses  chan keyPress
+	cancel   chan struct{}
+	canceled bool
+}
+
+func newKeyGrab(desc *reportDesc) *keyGrab {
+	return &keyGrab{
+		desc:    desc,
+		held:    heldKeys{},
+		pressed: make(map[uint8]bool),
+		presses: make(chan keyPress, keyGrabBuffer),
+		cancel:  make(chan struct{}),
+	}
+}
+
+// input decodes an input report, keys pressed since the last report are
+// sent to presses
+func (g *keyGrab) input(report []byte) {
+	if !g.held.update(g.desc, report) {
+		return
+	}
+	held := g.held.union(map[uint8]bool{})
+
+	var pressed []int
+	for k := range held {
+		if !g.pressed[k] {
+			pressed = append(pressed, int(k))
+		}
+	}
+	g.pressed = held
+
+	// keys pressed at once are taken in the order of usage IDs
+	sort.Ints(pressed)
+	for _, k := range pressed {
+		select {
+		case g.presses <- keyPress{uint8(k), held}:
+		default:
+			logrus.WithField("usage", k).Warnln("Key press dropped")
+		}
+	}
+}
+
+// grabKeys takes the input away from the client until ungrab, keys the
+// client sees held are released
+func (kb *Keyboard) grabKeys() (*keyGrab, error) {
+	kb.Lock()
+	defer kb.Unlock()
+
+	if kb.report == nil {
+		return nil, errors.New("keys can't be decoded without the HID descriptor")
+	}
+	if kb.grab != nil {
+		return nil, errInputGrabbed
+	}
+
+	g := newKeyGrab(kb.report)
+	for id, last := range kb.last {
+		// keys already held aren't pressed while grabbed
+		g.held.update(kb.report, last)
+
+		if !isIdle(last, kb.ids) {
+			r := make([]byte, len(last))
+			if kb.ids {
+				r[0] = id
+			}
+			kb.deliver(id, r)
+		}
+	}
+
+	g.pressed = g.held.union(map[uint8]bool{})
+
+	kb.grab = g
+	return g, nil
+}
+
+// ungrab gives the input back to the client
+func (kb *Keyboard) ungrab(g *keyGrab) {
+	kb.Lock()
+	defer kb.Unlock()
+
+	if kb.grab == g {
+		kb.grab = nil
+	}
+}
+
+// CancelInput gives up taking input from the keyboard, e.g. ReadPasskey,
+// and returns the input to the client
+func (kb *Keyboard) CancelInput() {
+	kb.Lock()
+	defer kb.Unlock()
+
+	if kb.grab != nil && !kb.grab.canceled {
+		kb.grab.canceled = true
+		close(kb.grab.cancel)
+	}
+}
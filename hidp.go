@@ -3,11 +3,12 @@ package btk
 import (
 	"bytes"
 	"fmt"
-	"syscall"
+	"path"
 	"text/template"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/godbus/dbus"
+	"github.com/inoc603/btk/l2cap"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 )
@@ -80,7 +81,7 @@ const sdpTpl = `
 		<uint16 value="0x0111" />
 	</attribute>
 	<attribute id="0x0202">
-		<uint8 value="0x40" />
+		<uint8 value="{{printf "0x%02x" .SubClass}}" />
 	</attribute>
 	<attribute id="0x0203">
 		<uint8 value="0x00" />
@@ -128,13 +129,27 @@ const sdpTpl = `
 </record>
 `
 
+const (
+	// PSMCTRL is the PSM of the HID control channel
+	PSMCTRL = 0x11
+	// PSMINTR is the PSM of the HID interrupt channel
+	PSMINTR = 0x13
+	// BUFSIZE is the size of read buffers of the channels if the MTU is
+	// unknown
+	BUFSIZE = 1024
+
+	// minSecurity is the lowest security level of the channels, i.e. an
+	// encrypted link
+	minSecurity = l2cap.SecurityMedium
+)
+
 // HidProfile represents a dbus profile for the keyboard
 type HidProfile struct {
 	bus  *dbus.Conn
 	path dbus.ObjectPath
 	uid  string
 
-	connIntr *Bluetooth
+	intr *intrMatcher
 
 	connection    chan *Client
 	disconnection chan *Client
@@ -159,8 +174,9 @@ func (p *HidProfile) Export() error {
 	)
 }
 
-// Register registers the profile to dbus
-func (p *HidProfile) Register(desc string) error {
+// Register registers the profile to dbus, with the hex encoded HID descriptor
+// and the HID device subclass, e.g. 0x40 for keyboard
+func (p *HidProfile) Register(desc string, subClass uint8) error {
 	callback := make(chan *dbus.Call, 1)
 
 	tpl, err := template.New("sdp").Parse(sdpTpl)
@@ -169,7 +185,10 @@ func (p *HidProfile) Register(desc string) error {
 	}
 
 	sdp := bytes.NewBuffer(nil)
-	if err := tpl.Execute(sdp, struct{ HIDDesc string }{desc}); err != nil {
+	if err := tpl.Execute(sdp, struct {
+		HIDDesc  string
+		SubClass uint8
+	}{desc, subClass}); err != nil {
 		return err
 	}
 
@@ -200,20 +219,27 @@ func (p *HidProfile) Unregister() error {
 
 // NewHidProfile returns a new HidProfile on the given path
 func NewHidProfile(path string) (*HidProfile, error) {
-	connIntr, err := ListenBluetooth(PSMINTR, 1, false)
+	connIntr, err := l2cap.Listen("", PSMINTR)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to listen bluetooth")
 	}
 
+	// keystrokes must not be sent in the clear
+	if err := connIntr.SetSecurity(minSecurity); err != nil {
+		connIntr.Close()
+		return nil, err
+	}
+
 	bus, err := dbus.SystemBus()
 	if err != nil {
+		connIntr.Close()
 		return nil, errors.Wrap(err, "failed to connect system bus")
 	}
 
 	return &HidProfile{
 		bus:           bus,
 		path:          (dbus.ObjectPath)(path),
-		connIntr:      connIntr,
+		intr:          newIntrMatcher(connIntr, intrTimeout),
 		uid:           uuid.NewV4().String(),
 		connection:    make(chan *Client),
 		disconnection: make(chan *Client),
@@ -230,37 +256,108 @@ func (p *HidProfile) Release() *dbus.Error {
 func (p *HidProfile) NewConnection(dev dbus.ObjectPath, fd dbus.UnixFD, fdProps map[string]dbus.Variant) *dbus.Error {
 	logrus.Debugln("NewConnection", dev, fd, fdProps)
 
-	sintr, err := p.connIntr.Accept()
+	sctrl, err := l2cap.FileConn(int(fd))
 	if err != nil {
-		logrus.WithError(err).Errorln("Accept failed")
-		p.connIntr.Close()
-		return dbus.NewError(fmt.Sprintf("Accept failed: %v", PSMINTR), []interface{}{err})
+		logrus.WithError(err).Errorln("Failed to create bluetooth socket")
+		return dbus.NewError("failed to create bluetooth socket", []interface{}{err.Error()})
 	}
 
-	logrus.Infoln("New bluetooth connection")
+	logrus.Infoln("New bluetooth socket created")
 
-	sctrl, err := NewBluetoothSocket(int(fd))
+	// the interrupt channel must be from the same device
+	sintr, err := p.intr.claim(sctrl.RemoteAddr().(*l2cap.Addr).BDAddr)
 	if err != nil {
-		logrus.WithError(err).Errorln("Failed to create bluetooth socket")
-		syscall.Close(int(fd))
-		return dbus.NewError("failed to create bluetooth socket", []interface{}{err})
+		logrus.WithError(err).Errorln("No interrupt channel")
+		sctrl.Close()
+		return dbus.NewError(fmt.Sprintf("no interrupt channel on PSM %#x", PSMINTR), []interface{}{err.Error()})
 	}
 
-	logrus.Infoln("New bluetooth socket created")
+	logrus.Infoln("New bluetooth connection")
+
+	if err := checkSecurity(sctrl, sintr); err != nil {
+		logrus.WithError(err).Errorln("Insecure bluetooth connection rejected")
+		sctrl.Close()
+		sintr.Close()
+		return dbus.NewError("insecure bluetooth connection", []interface{}{err.Error()})
+	}
 
 	p.connection <- &Client{dev, sintr, sctrl, make(chan struct{})}
 
 	return nil
 }
 
+// checkSecurity returns an error if any of the channels is not encrypted
+func checkSecurity(channels ...*l2cap.Conn) error {
+	for _, c := range channels {
+		sec, err := c.Security()
+		if err != nil {
+			return err
+		}
+
+		logger := logrus.WithFields(logrus.Fields{
+			"remote":   c.RemoteAddr(),
+			"security": sec.Level,
+			"key_size": sec.KeySize,
+		})
+		if opts, err := c.Options(); err == nil {
+			logger = logger.WithField("imtu", opts.IMTU).WithField("omtu", opts.OMTU)
+		}
+		logger.Debugln("Bluetooth channel")
+
+		if sec.Level < minSecurity {
+			return errors.Errorf("security level of %s is %s", c.RemoteAddr(), sec.Level)
+		}
+	}
+	return nil
+}
+
 // RequestDisconnection ... I don't know how to use this yet
 func (p *HidProfile) RequestDisconnection(dev dbus.ObjectPath) *dbus.Error {
 	logrus.WithField("device", dev).Infoln("Disconnection requested")
 	return nil
 }
 
+// RemoveDevice removes the bluetooth device from its adapter, along with
+// the bonding
+func (p *HidProfile) RemoveDevice(dev dbus.ObjectPath) error {
+	// device paths are like /org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF
+	adapter := dbus.ObjectPath(path.Dir(string(dev)))
+
+	return errors.Wrap(
+		p.bus.Object("org.bluez", adapter).Call(
+			"org.bluez.Adapter1.RemoveDevice",
+			0, dev,
+		).Err,
+		"failed to remove device",
+	)
+}
+
+// TrustDevice marks the bluetooth device as trusted, so its connections
+// are authorized without asking the agent
+func (p *HidProfile) TrustDevice(dev dbus.ObjectPath) error {
+	return errors.Wrap(
+		p.bus.Object("org.bluez", dev).Call(
+			"org.freedesktop.DBus.Properties.Set", 0,
+			"org.bluez.Device1", "Trusted", dbus.MakeVariant(true),
+		).Err,
+		"failed to trust device",
+	)
+}
+
+// BlockDevice marks the bluetooth device as blocked, so its connections are
+// refused until it's unblocked, e.g. by bluetoothctl unblock
+func (p *HidProfile) BlockDevice(dev dbus.ObjectPath) error {
+	return errors.Wrap(
+		p.bus.Object("org.bluez", dev).Call(
+			"org.freedesktop.DBus.Properties.Set", 0,
+			"org.bluez.Device1", "Blocked", dbus.MakeVariant(true),
+		).Err,
+		"failed to block device",
+	)
+}
+
 // Close shuts down the profile
 func (p *HidProfile) Close() {
 	p.bus.Close()
-	p.connIntr.Close()
+	p.intr.Close()
 }
@@ -0,0 +1,202 @@
+package btk
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	hidrawDir = "/dev"
+
+	hidMaxDescriptorSize = 4096
+	hidrawNameSize       = 256
+	hidrawBufSize        = 4096
+)
+
+// ioctl request numbers, see linux/hidraw.h
+var (
+	hidiocgrdescsize = ioc(iocRead, 'H', 0x01, 4)
+	hidiocgrdesc     = ioc(iocRead, 'H', 0x02, unsafe.Sizeof(hidrawReportDescriptor{}))
+	hidiocgrawinfo   = ioc(iocRead, 'H', 0x03, unsafe.Sizeof(HidrawInfo{}))
+	hidiocgrawname   = ioc(iocRead, 'H', 0x04, hidrawNameSize)
+)
+
+func hidiocsfeature(size int) uintptr {
+	return ioc(iocWrite|iocRead, 'H', 0x06, uintptr(size))
+}
+
+func hidiocgfeature(size int) uintptr {
+	return ioc(iocWrite|iocRead, 'H', 0x07, uintptr(size))
+}
+
+// hidrawReportDescriptor is struct hidraw_report_descriptor in linux/hidraw.h
+type hidrawReportDescriptor struct {
+	Size  uint32
+	Value [hidMaxDescriptorSize]byte
+}
+
+// HidrawInfo is struct hidraw_devinfo in linux/hidraw.h
+type HidrawInfo struct {
+	BusType uint32
+	Vendor  uint16
+	Product uint16
+}
+
+// HidrawSource is an InputSource on a linux hidraw device, i.e. /dev/hidrawN.
+// Reports and the descriptor are relayed as they are, and the device stays
+// bound to its kernel driver, so it works for any HID transport.
+type HidrawSource struct {
+	f    *os.File
+	desc []byte
+	info HidrawInfo
+	name string
+	ids  bool
+
+	done chan struct{}
+	once sync.Once
+}
+
+// OpenHidraw opens the given hidraw device, it can be a path or a name in
+// /dev, e.g. /dev/hidraw0 or hidraw0
+func OpenHidraw(dev string) (*HidrawSource, error) {
+	if !strings.Contains(dev, "/") {
+		dev = filepath.Join(hidrawDir, dev)
+	}
+
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open hidraw device")
+	}
+
+	src := &HidrawSource{f: f, done: make(chan struct{})}
+
+	if err := src.readDesc(); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to get HID descriptor")
+	}
+
+	if err := fileIoctl(f, hidiocgrawinfo, unsafe.Pointer(&src.info)); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to get hidraw device info")
+	}
+
+	name := make([]byte, hidrawNameSize)
+	if err := fileIoctl(f, hidiocgrawname, unsafe.Pointer(&name[0])); err == nil {
+		src.name = string(bytes.TrimRight(name, "\x00"))
+	}
+
+	logrus.WithField("path", dev).WithField("name", src.name).
+		Debugln("Hidraw device opened")
+
+	return src, nil
+}
+
+func (s *HidrawSource) readDesc() error {
+	var size uint32
+	if err := fileIoctl(s.f, hidiocgrdescsize, unsafe.Pointer(&size)); err != nil {
+		return err
+	}
+
+	rd := hidrawReportDescriptor{Size: size}
+	if err := fileIoctl(s.f, hidiocgrdesc, unsafe.Pointer(&rd)); err != nil {
+		return err
+	}
+
+	s.desc = append([]byte(nil), rd.Value[:rd.Size]...)
+	s.ids = hasReportIDs(s.desc)
+	return nil
+}
+
+// Desc returns the HID descriptor of the device
+func (s *HidrawSource) Desc() []byte {
+	return s.desc
+}
+
+// Info returns the bus type, vendor and product ID of the device
+func (s *HidrawSource) Info() HidrawInfo {
+	return s.info
+}
+
+// Name returns the name of the device
+func (s *HidrawSource) Name() string {
+	return s.name
+}
+
+// ReadReport reads the next input report, it's prefixed by the report ID if
+// the descriptor has report IDs
+func (s *HidrawSource) ReadReport() ([]byte, error) {
+	buf := make([]byte, hidrawBufSize)
+
+	n, err := s.f.Read(buf)
+	if err != nil {
+		select {
+		case <-s.done:
+			return nil, ErrSourceClosed
+		default:
+		}
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// withReportID returns the report prefixed with a report ID as hidraw
+// expects, which is 0 if the descriptor has no report IDs
+func (s *HidrawSource) withReportID(report []byte) []byte {
+	if s.ids {
+		return report
+	}
+	return append([]byte{0}, report...)
+}
+
+// WriteReport sends an output report to the device
+func (s *HidrawSource) WriteReport(report []byte) error {
+	_, err := s.f.Write(s.withReportID(report))
+	return err
+}
+
+// SetFeature sends a feature report to the device
+func (s *HidrawSource) SetFeature(report []byte) error {
+	if len(report) == 0 {
+		return errInvalidReportID
+	}
+
+	buf := s.withReportID(report)
+	return fileIoctl(s.f, hidiocsfeature(len(buf)), unsafe.Pointer(&buf[0]))
+}
+
+// GetFeature reads the feature report with the given ID from the device, the
+// returned report is prefixed by the report ID if the descriptor has report
+// IDs
+func (s *HidrawSource) GetFeature(id uint8) ([]byte, error) {
+	buf := make([]byte, hidrawBufSize)
+	buf[0] = id
+
+	n, err := fileIoctlRet(s.f, hidiocgfeature(len(buf)), unsafe.Pointer(&buf[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	// the report ID is always the first byte, even if it's not used
+	if !s.ids && n > 0 {
+		return buf[1:n], nil
+	}
+	return buf[:n], nil
+}
+
+// Close closes the device
+func (s *HidrawSource) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.f.Close()
+	})
+	return err
+}
@@ -0,0 +1,85 @@
+package btk
+
+import (
+	"bytes"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	netlinkKobjectUevent = 15
+	ueventBufSize        = 4096
+)
+
+// ueventConn receives kernel uevents, which tell when devices are added or
+// removed
+type ueventConn struct {
+	fd int
+}
+
+func newUeventConn() (*ueventConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM, netlinkKobjectUevent)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create uevent socket")
+	}
+	syscall.CloseOnExec(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Pid:    0,
+		Groups: 1,
+	}); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(err, "failed to bind uevent socket")
+	}
+
+	return &ueventConn{fd: fd}, nil
+}
+
+// waitAdd waits for at most timeout for a device to be added, it returns
+// true if there's one
+func (c *ueventConn) waitAdd(timeout time.Duration) bool {
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		time.Sleep(timeout)
+		return false
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, ueventBufSize)
+
+	for time.Now().Before(deadline) {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return false
+		}
+
+		// uevent messages start with "ACTION@DEVPATH"
+		if bytes.HasPrefix(buf[:n], []byte("add@")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *ueventConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// waitPlug waits until a device may be plugged, i.e. there's a uevent of a
+// new device or replugInterval passes. uevents may be nil if uevents can't be
+// watched.
+func waitPlug(uevents *ueventConn) {
+	if uevents == nil {
+		time.Sleep(replugInterval)
+		return
+	}
+
+	if uevents.waitAdd(replugInterval) {
+		// give udev some time to set up the device node
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,191 @@
+package btk
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSourceClosed is returned when reading from a closed input source
+var ErrSourceClosed = errors.New("input source closed")
+
+// errInvalidReportID is returned for reports of unknown report IDs
+var errInvalidReportID = errors.New("invalid report ID")
+
+// errUnsupported is returned when the source doesn't support a request
+var errUnsupported = errors.New("unsupported request")
+
+// InputSource is where a keyboard gets its HID reports from, e.g. a usb
+// keyboard claimed through usbfs.
+type InputSource interface {
+	// Desc returns the HID report descriptor of the source
+	Desc() []byte
+	// ReadReport blocks until the next input report is available. Any
+	// error returned is considered fatal, i.e. the source can't be read
+	// anymore because it's closed or disconnected
+	ReadReport() ([]byte, error)
+	// Close closes the source, a blocked ReadReport should return
+	Close() error
+}
+
+// OutputSink is an optional interface of an InputSource which accepts
+// output reports from the host, e.g. the state of keyboard LEDs
+type OutputSink interface {
+	WriteReport(report []byte) error
+}
+
+// FeatureSink is an optional interface of an InputSource which can set and
+// get feature reports of the device, e.g. backlight or firmware settings.
+// Reports are prefixed by the report ID if the descriptor has report IDs.
+type FeatureSink interface {
+	SetFeature(report []byte) error
+	GetFeature(id uint8) ([]byte, error)
+}
+
+func closeAll(sources []InputSource) {
+	for _, src := range sources {
+		src.Close()
+	}
+}
+
+// fanIn reads reports from several sources at once
+type fanIn struct {
+	sources []InputSource
+	reports chan fanInReport
+	done    chan struct{}
+	once    sync.Once
+	alive   int
+}
+
+type fanInReport struct {
+	index  int
+	report []byte
+	err    error
+}
+
+func newFanIn(sources []InputSource) *fanIn {
+	f := &fanIn{
+		sources: sources,
+		reports: make(chan fanInReport),
+		done:    make(chan struct{}),
+		alive:   len(sources),
+	}
+
+	for i := range sources {
+		go f.read(i)
+	}
+
+	return f
+}
+
+func (f *fanIn) read(i int) {
+	for {
+		report, err := f.sources[i].ReadReport()
+
+		select {
+		case f.reports <- fanInReport{i, report, err}:
+		case <-f.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// next returns the next report and the index of its source. A source is
+// dropped after a read error, which is returned as gone, and err is only
+// returned when all the sources are gone. next must not be called
+// concurrently.
+func (f *fanIn) next() (index int, report []byte, gone error, err error) {
+	select {
+	case r := <-f.reports:
+		if r.err == nil {
+			return r.index, r.report, nil, nil
+		}
+
+		f.alive--
+		if f.alive == 0 {
+			return r.index, nil, r.err, r.err
+		}
+		return r.index, nil, r.err, nil
+	case <-f.done:
+		return -1, nil, nil, ErrSourceClosed
+	}
+}
+
+func (f *fanIn) close() {
+	f.once.Do(func() {
+		close(f.done)
+		closeAll(f.sources)
+	})
+}
+
+// MemorySource is an in-memory InputSource, reports are fed with Send.
+// It's mostly useful for testing without real hardware.
+type MemorySource struct {
+	desc    []byte
+	reports chan []byte
+	done    chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	outputs [][]byte
+}
+
+// NewMemorySource returns a MemorySource with the given HID descriptor
+func NewMemorySource(desc []byte) *MemorySource {
+	return &MemorySource{
+		desc:    desc,
+		reports: make(chan []byte),
+		done:    make(chan struct{}),
+	}
+}
+
+// Desc returns the HID descriptor given to NewMemorySource
+func (s *MemorySource) Desc() []byte {
+	return s.desc
+}
+
+// Send feeds an input report to the source, it blocks until the report is
+// read, or the source is closed
+func (s *MemorySource) Send(report []byte) error {
+	select {
+	case s.reports <- report:
+		return nil
+	case <-s.done:
+		return ErrSourceClosed
+	}
+}
+
+// ReadReport returns the next report given to Send
+func (s *MemorySource) ReadReport() ([]byte, error) {
+	select {
+	case r := <-s.reports:
+		return r, nil
+	case <-s.done:
+		return nil, ErrSourceClosed
+	}
+}
+
+// WriteReport records the output report, see Outputs
+func (s *MemorySource) WriteReport(report []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outputs = append(s.outputs, append([]byte(nil), report...))
+	return nil
+}
+
+// Outputs returns all output reports written to the source so far
+func (s *MemorySource) Outputs() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.outputs...)
+}
+
+// Close closes the source
+func (s *MemorySource) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
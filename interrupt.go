@@ -0,0 +1,193 @@
+package btk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/inoc603/btk/l2cap"
+	"github.com/pkg/errors"
+)
+
+// intrTimeout is how long the control and interrupt channels of a device can
+// wait for each other
+const intrTimeout = 10 * time.Second
+
+var errIntrClosed = errors.New("interrupt listener closed")
+
+// intrMatcher accepts interrupt channels in its own loop, and hands them to
+// the control channels of the same devices. An interrupt channel not claimed
+// in time is an orphan, and it's closed.
+type intrMatcher struct {
+	l       intrListener
+	timeout time.Duration
+
+	mu sync.Mutex
+	// pending is the accepted interrupt channels not claimed yet
+	pending map[l2cap.BDAddr]*pendingIntr
+	// waiting is the control channels waiting for their interrupt channel,
+	// they're closed when the matcher is closed
+	waiting map[l2cap.BDAddr]chan *l2cap.Conn
+}
+
+// intrListener is what interrupt channels are accepted from, i.e. an
+// *l2cap.Listener
+type intrListener interface {
+	AcceptL2CAP() (*l2cap.Conn, error)
+	Close() error
+}
+
+type pendingIntr struct {
+	conn  *l2cap.Conn
+	timer *time.Timer
+}
+
+func newIntrMatcher(l intrListener, timeout time.Duration) *intrMatcher {
+	m := &intrMatcher{
+		l:       l,
+		timeout: timeout,
+		pending: make(map[l2cap.BDAddr]*pendingIntr),
+		waiting: make(map[l2cap.BDAddr]chan *l2cap.Conn),
+	}
+
+	go m.acceptLoop()
+	return m
+}
+
+// acceptLoop accepts interrupt channels until the listener is closed
+func (m *intrMatcher) acceptLoop() {
+	for {
+		conn, err := m.l.AcceptL2CAP()
+		if err != nil {
+			if m.closed() {
+				logrus.Debugln("Exit accepting interrupt channels")
+				return
+			}
+			logrus.WithError(err).Errorln("Accept failed")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		m.add(conn.RemoteAddr().(*l2cap.Addr).BDAddr, conn)
+	}
+}
+
+func (m *intrMatcher) closed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pending == nil
+}
+
+// add hands the interrupt channel of the device to the control channel
+// waiting for it, or keeps it until it's claimed
+func (m *intrMatcher) add(addr l2cap.BDAddr, conn *l2cap.Conn) {
+	logger := logrus.WithField("remote", addr)
+	logger.Infoln("New interrupt channel")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.pending == nil {
+		conn.Close()
+		return
+	}
+
+	if ch, ok := m.waiting[addr]; ok {
+		delete(m.waiting, addr)
+		ch <- conn
+		return
+	}
+
+	if old, ok := m.pending[addr]; ok {
+		logger.Warnln("Interrupt channel replaced by a new one")
+		old.timer.Stop()
+		old.conn.Close()
+	}
+
+	p := &pendingIntr{conn: conn}
+	p.timer = time.AfterFunc(m.timeout, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if m.pending[addr] != p {
+			return
+		}
+		delete(m.pending, addr)
+		logger.Warnln("Orphan interrupt channel rejected")
+		conn.Close()
+	})
+	m.pending[addr] = p
+}
+
+// claim returns the interrupt channel of the device, waiting for it if it's
+// not accepted yet
+func (m *intrMatcher) claim(addr l2cap.BDAddr) (*l2cap.Conn, error) {
+	m.mu.Lock()
+
+	if m.pending == nil {
+		m.mu.Unlock()
+		return nil, errIntrClosed
+	}
+
+	if p, ok := m.pending[addr]; ok {
+		delete(m.pending, addr)
+		p.timer.Stop()
+		m.mu.Unlock()
+		return p.conn, nil
+	}
+
+	if _, ok := m.waiting[addr]; ok {
+		m.mu.Unlock()
+		return nil, errors.Errorf("already waiting for interrupt channel of %s", addr)
+	}
+
+	ch := make(chan *l2cap.Conn, 1)
+	m.waiting[addr] = ch
+	m.mu.Unlock()
+
+	select {
+	case conn, ok := <-ch:
+		if !ok {
+			return nil, errIntrClosed
+		}
+		return conn, nil
+	case <-time.After(m.timeout):
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.waiting[addr] == ch {
+		delete(m.waiting, addr)
+	}
+
+	// the channel may be handed over or closed right after the timeout
+	select {
+	case conn, ok := <-ch:
+		if !ok {
+			return nil, errIntrClosed
+		}
+		return conn, nil
+	default:
+	}
+
+	return nil, errors.Errorf("timeout waiting for interrupt channel of %s", addr)
+}
+
+// Close closes the listener and all the pending interrupt channels, control
+// channels waiting for theirs fail
+func (m *intrMatcher) Close() error {
+	m.mu.Lock()
+	for _, p := range m.pending {
+		p.timer.Stop()
+		p.conn.Close()
+	}
+	m.pending = nil
+	for _, ch := range m.waiting {
+		close(ch)
+	}
+	m.waiting = nil
+	m.mu.Unlock()
+
+	return m.l.Close()
+}
@@ -0,0 +1,192 @@
+package btk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inoc603/btk/l2cap"
+	"github.com/pkg/errors"
+)
+
+var (
+	testAddr  = l2cap.BDAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	otherAddr = l2cap.BDAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x66}
+)
+
+// idleListener accepts nothing, interrupt channels are added to the matcher
+// by the tests
+type idleListener chan struct{}
+
+func (l idleListener) AcceptL2CAP() (*l2cap.Conn, error) {
+	<-l
+	return nil, errors.New("listener closed")
+}
+
+func (l idleListener) Close() error {
+	close(l)
+	return nil
+}
+
+func newTestMatcher(timeout time.Duration) *intrMatcher {
+	return newIntrMatcher(make(idleListener), timeout)
+}
+
+// waitClaim waits until a control channel is waiting for the device
+func waitClaim(t *testing.T, m *intrMatcher, addr l2cap.BDAddr) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		_, ok := m.waiting[addr]
+		m.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no control channel waiting for %s", addr)
+}
+
+func TestIntrMatcherInterruptFirst(t *testing.T) {
+	m := newTestMatcher(5 * time.Second)
+	defer m.Close()
+
+	intr, host := channelPair(t)
+	defer host.Close()
+
+	m.add(testAddr, intr)
+	conn, err := m.claim(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != intr {
+		t.Error("claimed another interrupt channel")
+	}
+	conn.Close()
+}
+
+func TestIntrMatcherControlFirst(t *testing.T) {
+	m := newTestMatcher(5 * time.Second)
+	defer m.Close()
+
+	intr, host := channelPair(t)
+	defer host.Close()
+	defer intr.Close()
+
+	claimed := make(chan *l2cap.Conn, 1)
+	go func() {
+		conn, err := m.claim(testAddr)
+		if err != nil {
+			t.Error(err)
+		}
+		claimed <- conn
+	}()
+
+	waitClaim(t, m, testAddr)
+	m.add(testAddr, intr)
+
+	select {
+	case conn := <-claimed:
+		if conn != intr {
+			t.Error("claimed another interrupt channel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("interrupt channel not handed to the control channel")
+	}
+}
+
+func TestIntrMatcherOtherDevice(t *testing.T) {
+	m := newTestMatcher(5 * time.Second)
+	defer m.Close()
+
+	intr, host := channelPair(t)
+	defer host.Close()
+	defer intr.Close()
+	other, otherHost := channelPair(t)
+	defer otherHost.Close()
+	defer other.Close()
+
+	claimed := make(chan *l2cap.Conn, 1)
+	go func() {
+		conn, err := m.claim(testAddr)
+		if err != nil {
+			t.Error(err)
+		}
+		claimed <- conn
+	}()
+	waitClaim(t, m, testAddr)
+
+	// the interrupt channel of another device is kept for it
+	m.add(otherAddr, other)
+	m.add(testAddr, intr)
+
+	select {
+	case conn := <-claimed:
+		if conn != intr {
+			t.Error("claimed the interrupt channel of another device")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("interrupt channel not handed to the control channel")
+	}
+
+	if conn, err := m.claim(otherAddr); err != nil || conn != other {
+		t.Errorf("interrupt channel of the other device not kept: %v", err)
+	}
+}
+
+func TestIntrMatcherTimeout(t *testing.T) {
+	m := newTestMatcher(50 * time.Millisecond)
+	defer m.Close()
+
+	if _, err := m.claim(testAddr); err == nil {
+		t.Error("claimed an interrupt channel which never came")
+	}
+
+	m.mu.Lock()
+	n := len(m.waiting)
+	m.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d control channels still waiting after the timeout", n)
+	}
+
+	// orphan interrupt channels are closed
+	intr, host := channelPair(t)
+	defer host.Close()
+	m.add(testAddr, intr)
+
+	host.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := host.Read(make([]byte, BUFSIZE)); n != 0 || err == nil {
+		t.Errorf("orphan interrupt channel still open: read %d, %v", n, err)
+	}
+
+	if _, err := m.claim(testAddr); err == nil {
+		t.Error("claimed an orphan interrupt channel")
+	}
+}
+
+func TestIntrMatcherCloseWhileWaiting(t *testing.T) {
+	m := newTestMatcher(5 * time.Second)
+
+	claimed := make(chan error, 1)
+	go func() {
+		_, err := m.claim(testAddr)
+		claimed <- err
+	}()
+	waitClaim(t, m, testAddr)
+
+	m.Close()
+
+	select {
+	case err := <-claimed:
+		if err != errIntrClosed {
+			t.Errorf("claim returned %v after close, want %v", err, errIntrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("control channel still waiting after close")
+	}
+
+	if _, err := m.claim(otherAddr); err != errIntrClosed {
+		t.Errorf("claim returned %v on a closed matcher", err)
+	}
+}
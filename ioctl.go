@@ -0,0 +1,68 @@
+package btk
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl request encoding, see asm-generic/ioctl.h
+const (
+	iocWrite = 1
+	iocRead  = 2
+
+	iocNRShift   = 0
+	iocTypeShift = 8
+	iocSizeShift = 16
+	iocDirShift  = 30
+)
+
+func ioc(dir, typ, nr, size uintptr) uintptr {
+	return dir<<iocDirShift | typ<<iocTypeShift | nr<<iocNRShift | size<<iocSizeShift
+}
+
+// fileIoctl runs ioctl on the file without putting it into blocking mode,
+// which File.Fd() does. arg is only converted to uintptr in the syscall,
+// so the memory it points to stays valid even if it's on the stack.
+func fileIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, err := fileIoctlRet(f, req, arg)
+	return err
+}
+
+// fileIoctlRet is fileIoctl that also returns the return value of ioctl
+func fileIoctlRet(f *os.File, req uintptr, arg unsafe.Pointer) (int, error) {
+	var r uintptr
+	err := fileIoctlCall(f, func(fd uintptr) syscall.Errno {
+		var errno syscall.Errno
+		r, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+		return errno
+	})
+	return int(r), err
+}
+
+// fileIoctlInt is fileIoctl with an integer argument instead of a pointer
+func fileIoctlInt(f *os.File, req uintptr, arg int) error {
+	return fileIoctlCall(f, func(fd uintptr) syscall.Errno {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+		return errno
+	})
+}
+
+func fileIoctlCall(f *os.File, call func(fd uintptr) syscall.Errno) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		errno = call(fd)
+	}); err != nil {
+		return err
+	}
+
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
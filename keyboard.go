@@ -1,60 +1,94 @@
 package btk
 
 import (
+	"bytes"
 	"encoding/hex"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/godbus/dbus"
+	"github.com/inoc603/btk/l2cap"
 	"github.com/pkg/errors"
-	"github.com/zserge/hid"
 )
 
 const (
-	hidpHeaderTransMask = 0xf0
-
-	hidpTransHandshake   = 0x00
-	hidpTransSetProtocol = 0x60
-	hidpTransData        = 0xa0
-
-	hidpHshkSuccessful = 0x00
-	hidpHshkErrUnknown = 0x0e
-
 	protocolKeyboard = 1
 	protocolMouse    = 2
 )
 
-func getFirstKeyboard() (kb hid.Device, found bool) {
-	hid.UsbWalk(func(d hid.Device) {
-		if found {
-			return
-		}
-
-		if d.Info().Protocol == protocolKeyboard {
-			kb = d
-			found = true
-		}
-	})
-
-	return
-}
-
 // Client represents a bluetooth client
 type Client struct {
 	Dev   dbus.ObjectPath
-	Sintr *Bluetooth
-	Sctrl *Bluetooth
+	Sintr *l2cap.Conn
+	Sctrl *l2cap.Conn
 	Done  chan struct{}
 }
 
+// KeyboardEvent is a change of the keyboard's input source
+type KeyboardEvent int
+
+const (
+	// KeyboardUnplugged means the input source is disconnected
+	KeyboardUnplugged KeyboardEvent = iota
+	// KeyboardPlugged means the input source is reopened after it's unplugged
+	KeyboardPlugged
+)
+
+func (e KeyboardEvent) String() string {
+	switch e {
+	case KeyboardUnplugged:
+		return "unplugged"
+	case KeyboardPlugged:
+		return "plugged"
+	}
+	return "unknown"
+}
+
+// replugInterval is how often to retry opening an unplugged input source if
+// there's no uevent of a new device
+const replugInterval = 2 * time.Second
+
 // Keyboard represents a HID keyboard
 type Keyboard struct {
 	sync.Mutex
 	client *Client
-	dev    hid.Device
+	src    InputSource
+	open   func() (InputSource, error)
+	desc   []byte
 	sdp    string
 	once   sync.Once
+	done   chan struct{}
+	events chan KeyboardEvent
+	// subscribed is true once Events is called, events aren't emitted
+	// before that
+	subscribed bool
+	// unplugged is true while the source is gone and not reopened yet
+	unplugged bool
+
+	// last is the last input report sent of each report ID, so the keys
+	// can be released when the source is gone
+	last map[uint8][]byte
+	ids  bool
+	// report is the parsed HID descriptor, nil if it can't be parsed
+	report *reportDesc
+	// output is the last output report of each report ID from the current
+	// client, e.g. the LED state
+	output map[uint8][]byte
+	// protocol is the protocol mode selected by the current client, boot
+	// translates reports to and from the boot protocol, nil in report mode
+	protocol Protocol
+	boot     *bootTranslator
+	// suspended is true while the current client is suspended, input is
+	// not sent until a key wakes it up
+	suspended bool
+	// unplugs is the clients unplugged by virtual cable unplug
+	unplugs chan *Client
+	// queue is the input reports to the current client
+	queue *reportQueue
+	// grab takes the input instead of the client while it's not nil
+	grab *keyGrab
 }
 
 // Desc returns the HID descriptor of the usb keyboard
@@ -62,26 +96,118 @@ func (kb *Keyboard) Desc() string {
 	return kb.sdp
 }
 
-// NewKeyboard returns a new keyboard on the first usb keyboard connected.
-func NewKeyboard() (*Keyboard, error) {
-	dev, ok := getFirstKeyboard()
-	if !ok {
-		return nil, errors.New("no hid keyboard found")
+// SubClass returns the HID device subclass for the SDP record, which tells if
+// it's a keyboard, a pointing device or both
+func (kb *Keyboard) SubClass() uint8 {
+	return subClass(kb.desc)
+}
+
+// NewKeyboard returns a new keyboard on the first usb HID interface matching
+// all the given matchers, or the first usb keyboard if there's no matcher.
+// The keyboard can be unplugged and plugged again while in use.
+func NewKeyboard(matchers ...DeviceMatcher) (*Keyboard, error) {
+	return NewKeyboardWithOpener(func() (InputSource, error) {
+		return OpenUsbKeyboard(matchers...)
+	})
+}
+
+// NewMergedKeyboard returns a new keyboard merging all usb HID interfaces
+// matching all the given matchers, or all usb keyboards if there's no
+// matcher. See MergedSource.
+func NewMergedKeyboard(matchers ...DeviceMatcher) (*Keyboard, error) {
+	return NewKeyboardWithOpener(func() (InputSource, error) {
+		return OpenMergedUsbKeyboards(matchers...)
+	})
+}
+
+// NewKeyboardWithSource returns a new keyboard reading from the given source,
+// HandleHID returns when the source is gone
+func NewKeyboardWithSource(src InputSource) *Keyboard {
+	report, err := parseDesc(src.Desc())
+	if err != nil {
+		logrus.WithError(err).Warnln("Failed to parse HID descriptor")
 	}
 
-	if err := dev.Open(); err != nil {
-		return nil, errors.Wrap(err, "failed to open hid device")
+	return &Keyboard{
+		src:      src,
+		desc:     src.Desc(),
+		sdp:      hex.EncodeToString(src.Desc()),
+		done:     make(chan struct{}),
+		events:   make(chan KeyboardEvent, 16),
+		last:     make(map[uint8][]byte),
+		output:   make(map[uint8][]byte),
+		unplugs:  make(chan *Client, 1),
+		ids:      hasReportIDs(src.Desc()),
+		report:   report,
+		protocol: ProtocolReport,
 	}
+}
 
-	desc, err := dev.HIDReport()
+// NewKeyboardWithOpener returns a new keyboard on the source returned by open.
+// When the source is gone, e.g. the keyboard is unplugged, open is retried
+// until it returns a new source.
+func NewKeyboardWithOpener(open func() (InputSource, error)) (*Keyboard, error) {
+	src, err := open()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get HID descriptor")
+		return nil, err
 	}
 
-	return &Keyboard{
-		dev: dev,
-		sdp: hex.EncodeToString(desc),
-	}, nil
+	kb := NewKeyboardWithSource(src)
+	kb.open = open
+	return kb, nil
+}
+
+// Events returns a channel of plug and unplug events of the keyboard, only
+// events after the first call are sent, and they are dropped if they're not
+// received in time
+func (kb *Keyboard) Events() <-chan KeyboardEvent {
+	kb.Lock()
+	defer kb.Unlock()
+	kb.subscribed = true
+	return kb.events
+}
+
+func (kb *Keyboard) emit(e KeyboardEvent) {
+	kb.Lock()
+	subscribed := kb.subscribed
+	kb.Unlock()
+
+	if !subscribed {
+		return
+	}
+
+	select {
+	case kb.events <- e:
+	default:
+		logrus.WithField("event", e).Debugln("Keyboard event dropped")
+	}
+}
+
+func (kb *Keyboard) source() InputSource {
+	kb.Lock()
+	defer kb.Unlock()
+	return kb.src
+}
+
+func (kb *Keyboard) setUnplugged(unplugged bool) {
+	kb.Lock()
+	defer kb.Unlock()
+	kb.unplugged = unplugged
+}
+
+func (kb *Keyboard) isUnplugged() bool {
+	kb.Lock()
+	defer kb.Unlock()
+	return kb.unplugged
+}
+
+func (kb *Keyboard) stopped() bool {
+	select {
+	case <-kb.done:
+		return true
+	default:
+		return false
+	}
 }
 
 // Client returns the current bluetooth client of the keyboard
@@ -91,45 +217,299 @@ func (kb *Keyboard) Client() *Client {
 	return kb.client
 }
 
-// HandleHID starts a loop to read from the usb keyboard, it blocks until there's
-// a fatal error reading from the keyboard, e.g. keyboard disconnection
+// HandleHID starts a loop to read from the input source, and send the reports
+// to the bluetooth client. It blocks until the keyboard is stopped, or the
+// source is gone and can't be reopened.
 func (kb *Keyboard) HandleHID() {
-	defer kb.dev.Close()
+	for {
+		err := kb.relay(kb.source())
+		if kb.stopped() {
+			return
+		}
+
+		logrus.WithError(err).Errorln("Error in read from keyboard")
+
+		kb.source().Close()
+		kb.releaseKeys()
+
+		if kb.open == nil {
+			return
+		}
+
+		kb.setUnplugged(true)
 
+		logrus.Warnln("Keyboard unplugged")
+		kb.emit(KeyboardUnplugged)
+
+		if !kb.replug() {
+			return
+		}
+
+		logrus.Infoln("Keyboard plugged")
+		kb.setUnplugged(false)
+		kb.applyOutput()
+		kb.emit(KeyboardPlugged)
+	}
+}
+
+// relay sends reports from the source to the client until a read error
+func (kb *Keyboard) relay(src InputSource) error {
 	for {
-		// Set timeout to 1 second, so read does not block forever
-		state, err := kb.dev.Read(-1, time.Second)
+		state, err := src.ReadReport()
 		if err != nil {
-			// connection timeout is normal when the keyboard is idle.
-			// Although inspecting the error message is not a good
-			// way to check the error, we'll get on with it to
-			// prevent the too many debug log
-			if err.Error() != "connection timed out" {
-				logrus.WithError(err).Errorln("Error in read from keyboard")
-			}
-			// TODO: handle fatal error like device disconnection
-			continue
+			return err
 		}
 
 		logrus.WithField("state", state).Debugln("Keyboard input")
 
-		client := kb.Client()
-		if client == nil {
-			continue
+		kb.send(state)
+	}
+}
+
+func (kb *Keyboard) send(state []byte) {
+	if len(state) == 0 {
+		return
+	}
+
+	id := uint8(0)
+	if kb.ids {
+		id = state[0]
+	}
+
+	// The report ID is part of the report, so it must be one the host
+	// knows from the descriptor
+	if kb.report != nil && kb.report.reportSize(reportInput, id) == 0 {
+		logrus.WithField("id", id).Debugln("Report of unknown ID dropped")
+		return
+	}
+
+	kb.Lock()
+	defer kb.Unlock()
+
+	// input taken locally, e.g. for a passkey, doesn't go to the client
+	if kb.grab != nil {
+		kb.grab.input(state)
+		return
+	}
+
+	kb.deliver(id, state)
+}
+
+// deliver sends an input report of the report ID to the client, the caller
+// must hold the lock
+func (kb *Keyboard) deliver(id uint8, state []byte) {
+	idle := isIdle(state, kb.ids)
+
+	kb.last[id] = state
+	if kb.queue == nil {
+		return
+	}
+
+	if kb.boot != nil {
+		var ok bool
+		if state, ok = kb.boot.input(state); !ok {
+			return
 		}
+		id = state[0]
+	}
 
-		if _, err := client.Sintr.Write(append([]byte{0xA1}, state...)); err != nil {
-			logrus.WithError(err).Errorln("Error in write to client")
-			continue
+	if kb.suspended {
+		if idle {
+			return
 		}
+		// any key wakes the host up
+		logrus.Infoln("Waking up the host")
+		kb.suspended = false
 	}
+
+	kb.write(id, state)
 }
 
-// Stop close the usb keyboard
+// write queues an input report to the current client, the caller must hold
+// the lock
+func (kb *Keyboard) write(id uint8, report []byte) {
+	if kb.queue != nil {
+		kb.queue.push(id, DataMessage(ReportInput, report).Bytes())
+	}
+}
+
+// Stats returns the delivery counters of input reports to the current
+// client
+func (kb *Keyboard) Stats() DeliveryStats {
+	kb.Lock()
+	defer kb.Unlock()
+
+	if kb.queue == nil {
+		return DeliveryStats{}
+	}
+	return kb.queue.Stats()
+}
+
+// isIdle tells if nothing is pressed in an input report, i.e. the data is
+// all zero
+func isIdle(report []byte, ids bool) bool {
+	if ids && len(report) > 0 {
+		report = report[1:]
+	}
+	for _, b := range report {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// resync sends the current input reports to the client, e.g. keys released
+// while the host is suspended
+func (kb *Keyboard) resync() {
+	kb.Lock()
+	defer kb.Unlock()
+
+	if kb.boot != nil {
+		if r, ok := kb.boot.report(ReportInput, bootReportKeyboard); ok {
+			kb.write(bootReportKeyboard, r)
+		}
+		return
+	}
+
+	for id, r := range kb.last {
+		kb.write(id, r)
+	}
+}
+
+// setOutput applies an output report from the client to the input source
+func (kb *Keyboard) setOutput(report []byte) error {
+	if len(report) == 0 {
+		return nil
+	}
+
+	kb.Lock()
+	if kb.boot != nil {
+		if len(report) < 2 || report[0] != bootReportKeyboard {
+			kb.Unlock()
+			return errInvalidReportID
+		}
+
+		r, ok := kb.boot.output(report[1:])
+		if !ok {
+			kb.Unlock()
+			return nil
+		}
+		report = r
+	}
+	kb.Unlock()
+
+	id := uint8(0)
+	if kb.ids {
+		id = report[0]
+	}
+
+	if kb.report != nil && kb.report.reportSize(reportOutput, id) == 0 {
+		return errInvalidReportID
+	}
+
+	kb.Lock()
+	kb.output[id] = report
+	src := kb.src
+	kb.Unlock()
+
+	return writeOutput(src, report)
+}
+
+// applyOutput sends the output reports of the current client to the input
+// source, reports the client hasn't sent are sent as all zero, i.e. LEDs off
+func (kb *Keyboard) applyOutput() {
+	if kb.report == nil {
+		return
+	}
+
+	var reports [][]byte
+	kb.Lock()
+	for _, id := range kb.report.reportIDsOf(reportOutput) {
+		r, ok := kb.output[id]
+		if !ok {
+			r = kb.report.encode(reportOutput, id, nil)
+		}
+		reports = append(reports, r)
+	}
+	src := kb.src
+	kb.Unlock()
+
+	for _, r := range reports {
+		if err := writeOutput(src, r); err != nil {
+			logrus.WithError(err).Warnln("Failed to apply output report")
+		}
+	}
+}
+
+func writeOutput(src InputSource, report []byte) error {
+	if sink, ok := src.(OutputSink); ok {
+		return sink.WriteReport(report)
+	}
+	return nil
+}
+
+// releaseKeys sends an empty report of each report ID to the client, so no
+// key is stuck on the host
+func (kb *Keyboard) releaseKeys() {
+	kb.Lock()
+	var empty [][]byte
+	for id, last := range kb.last {
+		r := make([]byte, len(last))
+		if kb.ids {
+			r[0] = id
+		}
+		empty = append(empty, r)
+	}
+	kb.Unlock()
+
+	for _, r := range empty {
+		kb.send(r)
+	}
+}
+
+// replug waits until the source is opened again, it returns false if the
+// keyboard is stopped
+func (kb *Keyboard) replug() bool {
+	uevents, err := newUeventConn()
+	if err != nil {
+		logrus.WithError(err).Warnln("Failed to watch uevents, polling for the keyboard")
+	} else {
+		defer uevents.Close()
+	}
+
+	for {
+		if kb.stopped() {
+			return false
+		}
+
+		if src, err := kb.open(); err == nil {
+			if !bytes.Equal(src.Desc(), kb.desc) {
+				logrus.Warnln("HID descriptor changed, reconnect the bluetooth host to apply")
+			}
+
+			kb.Lock()
+			kb.src = src
+			kb.Unlock()
+
+			// The source may be replaced after Stop closes the old one
+			if kb.stopped() {
+				src.Close()
+				return false
+			}
+			return true
+		}
+
+		waitPlug(uevents)
+	}
+}
+
+// Stop closes the input source of the keyboard
 func (kb *Keyboard) Stop() {
 	kb.once.Do(func() {
-		// Violently close the usb keyboard, HandleHID() will exit on error
-		kb.dev.Close()
+		close(kb.done)
+		// HandleHID() will exit on the read error
+		kb.source().Close()
 		logrus.Warnln("Keyboard stopped")
 	})
 }
@@ -146,40 +526,83 @@ func (kb *Keyboard) Connect(client *Client) error {
 		return errors.New("keyboard in use")
 	}
 
-	kb.client = client
-
-	if _, err := client.Sctrl.Write([]byte{0xA1, 0x13, 0x03}); err != nil {
+	if _, err := client.Sctrl.Write(DataMessage(ReportInput, []byte{0x13, 0x03}).Bytes()); err != nil {
 		return errors.Wrap(err, "failed to send hello on ctrl 1")
 	}
 
-	if _, err := client.Sctrl.Write([]byte{0xA1, 0x13, 0x02}); err != nil {
+	if _, err := client.Sctrl.Write(DataMessage(ReportInput, []byte{0x13, 0x02}).Bytes()); err != nil {
 		return errors.Wrap(err, "failed to send hello on ctrl 2")
 	}
 
-	go kb.handleHandshake()
+	kb.client = client
+	// LEDs of the last client don't apply to the new one
+	kb.output = make(map[uint8][]byte)
+	// the report protocol is the default after connection
+	kb.protocol = ProtocolReport
+	kb.boot = nil
+	kb.suspended = false
+	kb.queue = newReportQueue(client.Sintr, clientQueueSize)
+
+	go kb.handleControl(client)
+	go kb.handleInterrupt(client)
+	go kb.applyOutput()
 
 	return nil
 }
 
-// handleHandshake handles bluetooth handshake messages, and it's also an
-// indicator of client disconnection
-func (kb *Keyboard) handleHandshake() {
-	client := kb.client
-	if client == nil {
-		return
+// readSize returns the size of read buffers of the channel, which is the
+// incoming MTU, so no packet is truncated
+func readSize(c *l2cap.Conn) int {
+	if opts, err := c.Options(); err == nil && opts.IMTU > 0 {
+		return int(opts.IMTU)
 	}
+	return BUFSIZE
+}
+
+// handleInterrupt handles output reports on the interrupt channel, which is
+// how most hosts send the LED state
+func (kb *Keyboard) handleInterrupt(client *Client) {
 	logger := logrus.WithField("client", client.Dev)
-	logger.Debugln("Start handling handshake")
+	size := readSize(client.Sintr)
+
+	for {
+		r := make([]byte, size)
+		d, err := client.Sintr.Read(r)
+
+		if err != nil || d < 1 {
+			// the control channel handles disconnection
+			logger.WithError(err).Debugln("Exit handling interrupt")
+			return
+		}
+
+		m, _ := ParseMessage(r[:d])
+		if m.Type != TransData || m.ReportType() != ReportOutput {
+			logger.WithField("message", m).Debugln("Unexpected message on interrupt")
+			continue
+		}
+
+		if err := kb.setOutput(m.Data); err != nil {
+			logger.WithError(err).Warnln("Failed to set output report")
+		}
+	}
+}
+
+// handleControl handles messages on the control channel, and it's also an
+// indicator of client disconnection
+func (kb *Keyboard) handleControl(client *Client) {
+	logger := logrus.WithField("client", client.Dev)
+	logger.Debugln("Start handling control")
+	size := readSize(client.Sctrl)
 
 	for {
 		select {
 		case <-client.Done:
-			logger.Debugln("Exit handling handshake")
+			logger.Debugln("Exit handling control")
 			return
 		default:
 		}
 
-		r := make([]byte, BUFSIZE)
+		r := make([]byte, size)
 		d, err := client.Sctrl.Read(r)
 
 		if err != nil || d < 1 {
@@ -190,43 +613,322 @@ func (kb *Keyboard) handleHandshake() {
 			continue
 		}
 
-		hsk := []byte{hidpTransHandshake}
-		msgTyp := r[0] & hidpHeaderTransMask
+		m, _ := ParseMessage(r[:d])
+		logger.WithField("message", m).Debugln("Control message")
 
-		switch {
-		case (msgTyp & hidpTransSetProtocol) != 0:
-			logger.Debugln("handshake set protocol")
-			hsk[0] |= hidpHshkSuccessful
-			if _, err := client.Sctrl.Write(hsk); err != nil {
-				logger.WithError(err).Debugln("handshake set protocol failed")
-			}
-		case (msgTyp & hidpTransData) != 0:
-			logger.Debugln("handshake data")
-		default:
-			logger.Debugln("unknown handshake message")
-			hsk[0] |= hidpHshkErrUnknown
-			client.Sctrl.Write(hsk)
+		reply, ok := kb.reply(client, m)
+		if !ok {
+			continue
+		}
+
+		if _, err := client.Sctrl.Write(reply.Bytes()); err != nil {
+			logger.WithError(err).WithField("reply", reply).
+				Warnln("Failed to reply control message")
 		}
 	}
 }
 
-// Disconnect closes the connection to the given bluetooth client
-// Currently this is just some cleanning up. It can't close the actual
-// bluetooth connection, and will block on the attempt
-// TODO: Find a way to close the connection
+// reply handles a message from the control channel, and returns the reply
+// to send back if there should be one
+func (kb *Keyboard) reply(client *Client, m Message) (Message, bool) {
+	switch m.Type {
+	case TransHandshake, TransDatc:
+		// only the device sends these
+		return Message{}, false
+	case TransData:
+		// DATA on the control channel is deprecated, but accept output
+		// reports anyway since some hosts still send them
+		if m.ReportType() == ReportOutput {
+			kb.setOutput(m.Data)
+		}
+		return Message{}, false
+	case TransHIDControl:
+		return kb.hidControl(client, m.ControlOp())
+	}
+
+	// Requests below must be answered, NOT_READY tells the host to retry
+	// later while the keyboard is unplugged
+	if kb.isUnplugged() {
+		return Handshake(HandshakeNotReady), true
+	}
+
+	switch m.Type {
+	case TransGetReport:
+		return kb.getReport(m), true
+	case TransSetReport:
+		switch m.ReportType() {
+		case ReportFeature:
+			return Handshake(handshakeResult(kb.setFeature(m.Data))), true
+		case ReportOutput:
+			return Handshake(handshakeResult(kb.setOutput(m.Data))), true
+		case ReportOther:
+			return Handshake(HandshakeErrInvalidParameter), true
+		}
+		return Handshake(HandshakeErrUnsupportedRequest), true
+	case TransGetProtocol:
+		kb.Lock()
+		p := kb.protocol
+		kb.Unlock()
+		return DataMessage(ReportOther, []byte{uint8(p)}), true
+	case TransSetProtocol:
+		if m.Param&^uint8(ProtocolReport) != 0 {
+			return Handshake(HandshakeErrInvalidParameter), true
+		}
+		if !kb.setProtocol(m.Protocol()) {
+			return Handshake(HandshakeErrUnsupportedRequest), true
+		}
+		return Handshake(HandshakeSuccessful), true
+	case TransGetIdle, TransSetIdle:
+		return Handshake(HandshakeErrUnsupportedRequest), true
+	}
+
+	return Handshake(HandshakeErrUnsupportedRequest), true
+}
+
+// handshakeResult maps the result of a request to the input source to the
+// HANDSHAKE result
+func handshakeResult(err error) HandshakeResult {
+	switch errors.Cause(err) {
+	case nil:
+		return HandshakeSuccessful
+	case errInvalidReportID:
+		return HandshakeErrInvalidReportID
+	case errUnsupported, syscall.EPIPE:
+		// usb devices stall requests they don't support
+		return HandshakeErrUnsupportedRequest
+	case syscall.EINVAL:
+		return HandshakeErrInvalidParameter
+	case ErrSourceClosed, errSourceAbsent, syscall.ENODEV, syscall.ETIMEDOUT, syscall.EAGAIN:
+		return HandshakeNotReady
+	}
+	return HandshakeErrUnknown
+}
+
+// getReport answers a GET_REPORT request, feature reports are read from the
+// input source, while others are the last report of the type and ID. The report is truncated to the buffer size of the request.
+func (kb *Keyboard) getReport(m Message) Message {
+	kb.Lock()
+	boot := kb.boot
+	kb.Unlock()
+
+	// report IDs are always present in the boot protocol
+	req, err := m.GetReportRequest(kb.ids || boot != nil)
+	if err != nil {
+		return Handshake(HandshakeErrInvalidParameter)
+	}
+
+	var report []byte
+	ok := true
+	switch {
+	case boot != nil:
+		kb.Lock()
+		report, ok = boot.report(req.Type, req.ID)
+		kb.Unlock()
+	case req.Type == ReportFeature:
+		if report, err = kb.getFeature(req.ID); err != nil {
+			return Handshake(handshakeResult(err))
+		}
+	default:
+		report, ok = kb.lastReport(req.Type, req.ID)
+	}
+
+	if !ok {
+		return Handshake(HandshakeErrInvalidReportID)
+	}
+
+	if req.BufferSize > 0 && len(report) > req.BufferSize {
+		report = report[:req.BufferSize]
+	}
+
+	return DataMessage(req.Type, report)
+}
+
+// lastReport returns the last report of the type and ID, or an all zero
+// report if there isn't one yet. It returns false if the ID is unknown.
+func (kb *Keyboard) lastReport(typ ReportType, id uint8) ([]byte, bool) {
+	kb.Lock()
+	defer kb.Unlock()
+
+	var reports map[uint8][]byte
+	switch typ {
+	case ReportInput:
+		reports = kb.last
+	case ReportOutput:
+		reports = kb.output
+	}
+
+	if kb.report == nil {
+		// without a parsed descriptor any report seen is valid
+		r, ok := reports[id]
+		return r, ok
+	}
+
+	if kb.report.reportSize(typ.descType(), id) == 0 {
+		return nil, false
+	}
+
+	if r, ok := reports[id]; ok {
+		return r, true
+	}
+	return kb.report.encode(typ.descType(), id, nil), true
+}
+
+// setFeature sends a feature report from the client to the input source
+func (kb *Keyboard) setFeature(report []byte) error {
+	if len(report) == 0 {
+		return errInvalidReportID
+	}
+
+	id := uint8(0)
+	if kb.ids {
+		id = report[0]
+	}
+
+	if kb.report != nil && kb.report.reportSize(reportFeature, id) == 0 {
+		return errInvalidReportID
+	}
+
+	return setFeature(kb.source(), report)
+}
+
+// getFeature reads a feature report from the input source
+func (kb *Keyboard) getFeature(id uint8) ([]byte, error) {
+	if kb.report != nil && kb.report.reportSize(reportFeature, id) == 0 {
+		return nil, errInvalidReportID
+	}
+
+	return getFeature(kb.source(), id)
+}
+
+func setFeature(src InputSource, report []byte) error {
+	if sink, ok := src.(FeatureSink); ok {
+		return sink.SetFeature(report)
+	}
+	return errUnsupported
+}
+
+func getFeature(src InputSource, id uint8) ([]byte, error) {
+	if sink, ok := src.(FeatureSink); ok {
+		return sink.GetFeature(id)
+	}
+	return nil, errUnsupported
+}
+
+// setProtocol switches the protocol mode of the current client, it returns
+// false if the boot protocol is requested but the descriptor can't be parsed
+// to translate reports
+func (kb *Keyboard) setProtocol(p Protocol) bool {
+	if p == ProtocolBoot && kb.report == nil {
+		return false
+	}
+
+	kb.Lock()
+	defer kb.Unlock()
+
+	if p == kb.protocol {
+		return true
+	}
+
+	logrus.WithField("protocol", p).Infoln("Protocol mode changed")
+	kb.protocol = p
+	kb.boot = nil
+
+	if p == ProtocolBoot {
+		// keys already held are in the boot reports from now on
+		kb.boot = newBootTranslator(kb.report)
+		for _, r := range kb.last {
+			kb.boot.input(r)
+		}
+	}
+	return true
+}
+
+// hidControl handles a HID_CONTROL request, only invalid ones are replied
+func (kb *Keyboard) hidControl(client *Client, op ControlOp) (Message, bool) {
+	logger := logrus.WithFields(logrus.Fields{
+		"client":  client.Dev,
+		"control": op,
+	})
+
+	switch op {
+	case ControlNop, ControlHardReset, ControlSoftReset:
+		// deprecated, nothing to do
+	case ControlSuspend:
+		logger.Infoln("Host suspended")
+		kb.Lock()
+		kb.suspended = true
+		kb.Unlock()
+	case ControlExitSuspend:
+		logger.Infoln("Host resumed")
+		kb.Lock()
+		kb.suspended = false
+		kb.Unlock()
+		kb.resync()
+	case ControlVirtualCableUnplug:
+		logger.Infoln("Virtual cable unplugged by host")
+		kb.unplug(client)
+	default:
+		return Handshake(HandshakeErrInvalidParameter), true
+	}
+	return Message{}, false
+}
+
+// Unplugs returns a channel of clients unplugged by virtual cable unplug,
+// either by the host or by Unplug. The bonding of the clients should be
+// removed, see HidProfile.RemoveDevice.
+func (kb *Keyboard) Unplugs() <-chan *Client {
+	return kb.unplugs
+}
+
+// Unplug sends virtual cable unplug to the current client and disconnects
+// it, the host should forget the keyboard
+func (kb *Keyboard) Unplug() error {
+	client := kb.Client()
+	if client == nil {
+		return errors.New("no client connected")
+	}
+
+	logrus.WithField("client", client.Dev).Infoln("Unplugging virtual cable")
+
+	if _, err := client.Sctrl.Write(ControlMessage(ControlVirtualCableUnplug).Bytes()); err != nil {
+		return errors.Wrap(err, "failed to send virtual cable unplug")
+	}
+
+	kb.unplug(client)
+	return nil
+}
+
+func (kb *Keyboard) unplug(client *Client) {
+	if err := kb.Disconnect(client); err != nil {
+		logrus.WithError(err).Warnln("Failed to disconnect unplugged client")
+	}
+
+	select {
+	case kb.unplugs <- client:
+	default:
+		logrus.WithField("client", client.Dev).Warnln("Unplugged client dropped")
+	}
+}
+
+// Disconnect closes the connection to the given bluetooth client, pending
+// reads and writes on its channels return
 func (kb *Keyboard) Disconnect(client *Client) error {
 	kb.Lock()
 	defer kb.Unlock()
 
-	if client == nil || client.Dev != kb.client.Dev {
+	if client == nil || kb.client == nil || client.Dev != kb.client.Dev {
 		return nil
 	}
 
 	logrus.WithField("client", client.Dev).Infoln("Disconnecting")
 
+	kb.queue.close()
+	logrus.WithField("stats", kb.queue.Stats()).Debugln("Delivery stats")
+
 	defer func() {
 		close(kb.client.Done)
 		kb.client = nil
+		kb.queue = nil
 	}()
 
 	if err := client.Sctrl.Close(); err != nil {
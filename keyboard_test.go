@@ -0,0 +1,372 @@
+package btk
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/inoc603/btk/l2cap"
+	"github.com/pkg/errors"
+)
+
+var testClient = &Client{Dev: "/org/bluez/hci0/dev_00_11_22_33_44_55"}
+
+func bootKeys(keys ...uint8) []byte {
+	r := make([]byte, 8)
+	copy(r[2:], keys)
+	return r
+}
+
+func TestKeyboardReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		m     Message
+		reply bool
+		want  Message
+	}{
+		{"handshake", Handshake(HandshakeSuccessful), false, Message{}},
+		{"datc", Message{Type: TransDatc, Param: uint8(ReportOutput)}, false, Message{}},
+		{"data output", DataMessage(ReportOutput, []byte{0x01}), false, Message{}},
+		{"control nop", ControlMessage(ControlNop), false, Message{}},
+		{"control invalid", ControlMessage(0x9), true, Handshake(HandshakeErrInvalidParameter)},
+		{"get input", Message{Type: TransGetReport, Param: uint8(ReportInput)}, true, DataMessage(ReportInput, make([]byte, 8))},
+		{"get input size", GetReportMessage(GetReportRequest{Type: ReportInput, BufferSize: 3}, false), true, DataMessage(ReportInput, make([]byte, 3))},
+		{"get output", Message{Type: TransGetReport, Param: uint8(ReportOutput)}, true, DataMessage(ReportOutput, []byte{0x00})},
+		{"get feature", Message{Type: TransGetReport, Param: uint8(ReportFeature)}, true, Handshake(HandshakeErrInvalidReportID)},
+		{"get other", Message{Type: TransGetReport, Param: uint8(ReportOther)}, true, Handshake(HandshakeErrInvalidParameter)},
+		{"get with id", Message{Type: TransGetReport, Param: uint8(ReportInput), Data: []byte{0x01}}, true, Handshake(HandshakeErrInvalidParameter)},
+		{"set output", Message{Type: TransSetReport, Param: uint8(ReportOutput), Data: []byte{0x02}}, true, Handshake(HandshakeSuccessful)},
+		{"set feature", Message{Type: TransSetReport, Param: uint8(ReportFeature), Data: []byte{0x01}}, true, Handshake(HandshakeErrInvalidReportID)},
+		{"set input", Message{Type: TransSetReport, Param: uint8(ReportInput), Data: make([]byte, 8)}, true, Handshake(HandshakeErrUnsupportedRequest)},
+		{"set other", Message{Type: TransSetReport, Param: uint8(ReportOther)}, true, Handshake(HandshakeErrInvalidParameter)},
+		{"get protocol", Message{Type: TransGetProtocol}, true, DataMessage(ReportOther, []byte{uint8(ProtocolReport)})},
+		{"set boot protocol", Message{Type: TransSetProtocol, Param: uint8(ProtocolBoot)}, true, Handshake(HandshakeSuccessful)},
+		{"set invalid protocol", Message{Type: TransSetProtocol, Param: 0x2}, true, Handshake(HandshakeErrInvalidParameter)},
+		{"get idle", Message{Type: TransGetIdle}, true, Handshake(HandshakeErrUnsupportedRequest)},
+		{"set idle", Message{Type: TransSetIdle, Data: []byte{0x00}}, true, Handshake(HandshakeErrUnsupportedRequest)},
+		{"unknown", Message{Type: 0x3}, true, Handshake(HandshakeErrUnsupportedRequest)},
+	}
+
+	for _, test := range tests {
+		kb := NewKeyboardWithSource(NewMemorySource(bootKeyboardDesc))
+
+		m, reply := kb.reply(testClient, test.m)
+		if reply != test.reply {
+			t.Errorf("%s: reply %v, want %v", test.name, reply, test.reply)
+			continue
+		}
+		if m.Type != test.want.Type || m.Param != test.want.Param || !bytes.Equal(m.Data, test.want.Data) {
+			t.Errorf("%s: replied %v, want %v", test.name, m, test.want)
+		}
+	}
+
+	// replies depending on the input source
+	absent, _ := NewReopeningSource(idConsumerDesc, nil, func() (InputSource, error) {
+		return nil, errors.New("not plugged")
+	})
+
+	setFeature := Message{Type: TransSetReport, Param: uint8(ReportFeature), Data: []byte{2, 0x40}}
+	getFeature := Message{Type: TransGetReport, Param: uint8(ReportFeature), Data: []byte{2}}
+
+	sourceTests := []struct {
+		name string
+		src  InputSource
+		m    Message
+		want Message
+	}{
+		{"set feature absent", absent, setFeature, Handshake(HandshakeNotReady)},
+		{"get feature absent", absent, getFeature, Handshake(HandshakeNotReady)},
+		{"set feature unsupported", NewMemorySource(idConsumerDesc), setFeature, Handshake(HandshakeErrUnsupportedRequest)},
+		{"get feature unsupported", NewMemorySource(idConsumerDesc), getFeature, Handshake(HandshakeErrUnsupportedRequest)},
+	}
+
+	for _, test := range sourceTests {
+		kb := NewKeyboardWithSource(test.src)
+
+		m, _ := kb.reply(testClient, test.m)
+		if m.Type != test.want.Type || m.Param != test.want.Param || !bytes.Equal(m.Data, test.want.Data) {
+			t.Errorf("%s: replied %v, want %v", test.name, m, test.want)
+		}
+	}
+}
+
+func TestKeyboardFeatureReports(t *testing.T) {
+	src := newFeatureSource(idConsumerDesc)
+	kb := NewKeyboardWithSource(src)
+
+	set := Message{Type: TransSetReport, Param: uint8(ReportFeature), Data: []byte{2, 0x40}}
+	if r, _ := kb.reply(testClient, set); r.Type != TransHandshake || HandshakeResult(r.Param) != HandshakeSuccessful {
+		t.Errorf("SET_REPORT replied %v, want SUCCESSFUL", r)
+	}
+	if r := src.features[2]; !bytes.Equal(r, []byte{2, 0x40}) {
+		t.Errorf("source feature is %x, want 0240", r)
+	}
+
+	// the device is asked, not the last report from the host
+	src.features[2] = []byte{2, 0x41}
+	get := Message{Type: TransGetReport, Param: uint8(ReportFeature), Data: []byte{2}}
+	if r, _ := kb.reply(testClient, get); !bytes.Equal(r.Bytes(), DataMessage(ReportFeature, []byte{2, 0x41}).Bytes()) {
+		t.Errorf("GET_REPORT replied %v, want the feature report of the source", r)
+	}
+
+	get.Data = []byte{1}
+	if r, _ := kb.reply(testClient, get); r.Type != TransHandshake || HandshakeResult(r.Param) != HandshakeErrInvalidReportID {
+		t.Errorf("GET_REPORT of an input report ID replied %v, want ERR_INVALID_REPORT_ID", r)
+	}
+}
+
+func TestKeyboardReplyUnplugged(t *testing.T) {
+	kb := NewKeyboardWithSource(NewMemorySource(bootKeyboardDesc))
+	kb.setUnplugged(true)
+
+	for _, m := range []Message{
+		{Type: TransGetReport, Param: uint8(ReportInput)},
+		{Type: TransSetReport, Param: uint8(ReportOutput), Data: []byte{0x01}},
+		{Type: TransGetProtocol},
+	} {
+		r, reply := kb.reply(testClient, m)
+		if !reply || r.Type != TransHandshake || HandshakeResult(r.Param) != HandshakeNotReady {
+			t.Errorf("%v replied %v while unplugged, want NOT_READY", m, r)
+		}
+	}
+
+	// the host doesn't expect replies to these
+	if r, reply := kb.reply(testClient, ControlMessage(ControlNop)); reply {
+		t.Errorf("HID_CONTROL replied %v while unplugged", r)
+	}
+}
+
+// channelPair returns both ends of a socket pair in packet mode, standing in
+// for an L2CAP channel between the keyboard and the host
+func channelPair(t *testing.T) (*l2cap.Conn, *l2cap.Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kb, err := l2cap.FileConn(fds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := l2cap.FileConn(fds[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kb, host
+}
+
+// testHost is the host end of a client connected to a keyboard
+type testHost struct {
+	t     *testing.T
+	intr  *l2cap.Conn
+	ctrl  *l2cap.Conn
+	kb    *Keyboard
+	src   *MemorySource
+	hid   chan struct{}
+	close func()
+}
+
+// connectHost starts a keyboard on a MemorySource of the boot keyboard, and
+// connects a client to it
+func connectHost(t *testing.T) *testHost {
+	src := NewMemorySource(bootKeyboardDesc)
+	h := connectKeyboard(t, NewKeyboardWithSource(src))
+	h.src = src
+	return h
+}
+
+// connectKeyboard starts the keyboard, and connects a client to it
+func connectKeyboard(t *testing.T, kb *Keyboard) *testHost {
+	hid := make(chan struct{})
+	go func() {
+		kb.HandleHID()
+		close(hid)
+	}()
+
+	sintr, intr := channelPair(t)
+	sctrl, ctrl := channelPair(t)
+	client := &Client{Dev: testClient.Dev, Sintr: sintr, Sctrl: sctrl, Done: make(chan struct{})}
+	if err := kb.Connect(client); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &testHost{t: t, intr: intr, ctrl: ctrl, kb: kb, hid: hid}
+	h.close = func() {
+		kb.Stop()
+		// the keyboard disconnects the client once the host is gone
+		intr.Close()
+		ctrl.Close()
+	}
+
+	// the keyboard says hello on the control channel first
+	for _, hello := range [][]byte{{0xa1, 0x13, 0x03}, {0xa1, 0x13, 0x02}} {
+		if p := h.read(ctrl); !bytes.Equal(p, hello) {
+			t.Fatalf("hello %x, want %x", p, hello)
+		}
+	}
+	return h
+}
+
+func (h *testHost) read(c *l2cap.Conn) []byte {
+	h.t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, BUFSIZE)
+	n, err := c.Read(b)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return b[:n]
+}
+
+func (h *testHost) send(report []byte) {
+	h.t.Helper()
+
+	if err := h.src.Send(report); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// expectInput checks the next frame on the interrupt channel is the input
+// report
+func (h *testHost) expectInput(report []byte) {
+	h.t.Helper()
+
+	want := DataMessage(ReportInput, report).Bytes()
+	if p := h.read(h.intr); !bytes.Equal(p, want) {
+		h.t.Errorf("interrupt frame %x, want %x", p, want)
+	}
+}
+
+func TestKeyboardInputFrames(t *testing.T) {
+	h := connectHost(t)
+	defer h.close()
+
+	h.send(bootKeys(0x04))
+	h.expectInput(bootKeys(0x04))
+
+	h.send(bootKeys(0x04, 0x05))
+	h.expectInput(bootKeys(0x04, 0x05))
+
+	shift := bootKeys()
+	shift[0] = 0x02
+	h.send(shift)
+	h.expectInput(shift)
+
+	h.send(bootKeys())
+	h.expectInput(bootKeys())
+}
+
+func TestKeyboardReleasesKeysWhenSourceCloses(t *testing.T) {
+	h := connectHost(t)
+	defer h.close()
+
+	h.send(bootKeys(0x04, 0x05))
+	h.expectInput(bootKeys(0x04, 0x05))
+
+	h.src.Close()
+	h.expectInput(bootKeys())
+
+	// without an opener, HandleHID returns when the source is gone
+	select {
+	case <-h.hid:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleHID still running after the source closed")
+	}
+}
+
+func TestKeyboardReplug(t *testing.T) {
+	first := NewMemorySource(bootKeyboardDesc)
+	sources := make(chan InputSource, 2)
+	sources <- first
+
+	kb, err := NewKeyboardWithOpener(func() (InputSource, error) {
+		select {
+		case src := <-sources:
+			return src, nil
+		default:
+			return nil, errors.New("keyboard not plugged")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := kb.Events()
+
+	h := connectKeyboard(t, kb)
+	defer h.close()
+	h.src = first
+
+	h.send(bootKeys(0x04))
+	h.expectInput(bootKeys(0x04))
+
+	// the keys are released while the keyboard is unplugged, and the
+	// client stays connected until it's plugged again
+	second := NewMemorySource(bootKeyboardDesc)
+	sources <- second
+	first.Close()
+	h.expectInput(bootKeys())
+
+	for _, want := range []KeyboardEvent{KeyboardUnplugged, KeyboardPlugged} {
+		select {
+		case e := <-events:
+			if e != want {
+				t.Errorf("event %v, want %v", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v event", want)
+		}
+	}
+
+	h.src = second
+	h.send(bootKeys(0x05))
+	h.expectInput(bootKeys(0x05))
+}
+
+// expectOutput waits until the output report is written to the source
+func (h *testHost) expectOutput(report []byte) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, r := range h.src.Outputs() {
+			if bytes.Equal(r, report) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.t.Errorf("output report %x not written to the source, got %x", report, h.src.Outputs())
+}
+
+func TestKeyboardOutputRouting(t *testing.T) {
+	h := connectHost(t)
+	defer h.close()
+
+	// LEDs are off until the host sets them
+	h.expectOutput([]byte{0x00})
+
+	// most hosts send LEDs on the interrupt channel
+	if _, err := h.intr.Write(DataMessage(ReportOutput, []byte{0x02}).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	h.expectOutput([]byte{0x02})
+
+	// others send SET_REPORT on the control channel, which is answered
+	if _, err := h.ctrl.Write(Message{Type: TransSetReport, Param: uint8(ReportOutput), Data: []byte{0x05}}.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if p := h.read(h.ctrl); !bytes.Equal(p, Handshake(HandshakeSuccessful).Bytes()) {
+		t.Errorf("SET_REPORT replied %x, want SUCCESSFUL", p)
+	}
+	h.expectOutput([]byte{0x05})
+
+	// the host reads back the LEDs it set
+	if _, err := h.ctrl.Write(Message{Type: TransGetReport, Param: uint8(ReportOutput)}.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if p, want := h.read(h.ctrl), DataMessage(ReportOutput, []byte{0x05}).Bytes(); !bytes.Equal(p, want) {
+		t.Errorf("GET_REPORT replied %x, want %x", p, want)
+	}
+}
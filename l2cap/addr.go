@@ -0,0 +1,76 @@
+package l2cap
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// BDAddr is a bluetooth device address in the order it's written, e.g.
+// AA:BB:CC:DD:EE:FF is BDAddr{0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF}
+type BDAddr [6]uint8
+
+// BDAddrAny is the wildcard address, listening on it accepts connections
+// from all adapters
+var BDAddrAny = BDAddr{}
+
+// ParseBDAddr parses a bluetooth device address like AA:BB:CC:DD:EE:FF
+func ParseBDAddr(s string) (BDAddr, error) {
+	var a BDAddr
+
+	if len(s) != 3*len(a)-1 {
+		return a, errors.Errorf("invalid bluetooth address %q", s)
+	}
+
+	for i := range a {
+		if i > 0 && s[3*i-1] != ':' {
+			return a, errors.Errorf("invalid bluetooth address %q", s)
+		}
+
+		b, err := strconv.ParseUint(s[3*i:3*i+2], 16, 8)
+		if err != nil {
+			return a, errors.Errorf("invalid bluetooth address %q", s)
+		}
+		a[i] = uint8(b)
+	}
+
+	return a, nil
+}
+
+func (a BDAddr) String() string {
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", a[0], a[1], a[2], a[3], a[4], a[5])
+}
+
+// raw returns the address in the byte order of the kernel, which is
+// reversed
+func (a BDAddr) raw() [6]uint8 {
+	var r [6]uint8
+	for i := range a {
+		r[i] = a[len(a)-1-i]
+	}
+	return r
+}
+
+func bdaddrFromRaw(r [6]uint8) BDAddr {
+	var a BDAddr
+	for i := range r {
+		a[i] = r[len(r)-1-i]
+	}
+	return a
+}
+
+// Addr is the address of an L2CAP socket, it implements net.Addr
+type Addr struct {
+	BDAddr BDAddr
+	PSM    uint16
+}
+
+// Network returns "l2cap"
+func (a *Addr) Network() string {
+	return network
+}
+
+func (a *Addr) String() string {
+	return fmt.Sprintf("%s/0x%02x", a.BDAddr, a.PSM)
+}
@@ -0,0 +1,85 @@
+package l2cap
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestParseBDAddr(t *testing.T) {
+	tests := []struct {
+		s    string
+		addr BDAddr
+		ok   bool
+	}{
+		{"00:11:22:33:44:55", BDAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}, true},
+		{"AA:BB:CC:DD:EE:FF", BDAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, true},
+		{"aa:bb:cc:dd:ee:ff", BDAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, true},
+		{"", BDAddr{}, false},
+		{"00:11:22:33:44", BDAddr{}, false},
+		{"00:11:22:33:44:55:66", BDAddr{}, false},
+		{"00-11-22-33-44-55", BDAddr{}, false},
+		{"0011:22:33:44:55:", BDAddr{}, false},
+		{"00:11:22:33:44:GG", BDAddr{}, false},
+		{"+0:11:22:33:44:55", BDAddr{}, false},
+		{" 0:11:22:33:44:55", BDAddr{}, false},
+	}
+
+	for _, test := range tests {
+		addr, err := ParseBDAddr(test.s)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("ParseBDAddr(%q) error %v", test.s, err)
+			continue
+		}
+		if err == nil && addr != test.addr {
+			t.Errorf("ParseBDAddr(%q) = %v, want %v", test.s, addr, test.addr)
+		}
+	}
+}
+
+func TestBDAddrString(t *testing.T) {
+	tests := []struct {
+		addr BDAddr
+		s    string
+	}{
+		{BDAddrAny, "00:00:00:00:00:00"},
+		{BDAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}, "00:11:22:33:44:55"},
+		{BDAddr{0xaa, 0xbb, 0xcc, 0x0d, 0xee, 0xff}, "AA:BB:CC:0D:EE:FF"},
+	}
+
+	for _, test := range tests {
+		if s := test.addr.String(); s != test.s {
+			t.Errorf("%v.String() = %q, want %q", [6]uint8(test.addr), s, test.s)
+		}
+		if addr, err := ParseBDAddr(test.s); err != nil || addr != test.addr {
+			t.Errorf("ParseBDAddr(%q) = %v, %v", test.s, addr, err)
+		}
+	}
+}
+
+func TestBDAddrRaw(t *testing.T) {
+	addr := BDAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+	// the kernel keeps addresses little endian
+	raw := addr.raw()
+	if raw != [6]uint8{0x55, 0x44, 0x33, 0x22, 0x11, 0x00} {
+		t.Errorf("%v.raw() = %x", addr, raw)
+	}
+	if a := bdaddrFromRaw(raw); a != addr {
+		t.Errorf("bdaddrFromRaw(%x) = %v, want %v", raw, a, addr)
+	}
+
+	a := &Addr{BDAddr: addr, PSM: 0x11}
+	if s := a.String(); s != "00:11:22:33:44:55/0x11" {
+		t.Errorf("Addr.String() = %q", s)
+	}
+	if rsa := a.sockaddr(); addrFromRaw(&rsa).String() != a.String() {
+		t.Errorf("sockaddr %+v doesn't decode to %v", rsa, a)
+	}
+}
+
+func TestRawSockaddrSize(t *testing.T) {
+	// struct sockaddr_l2 of <bluetooth/l2cap.h>
+	if size := unsafe.Sizeof(rawSockaddrL2{}); size != 14 {
+		t.Errorf("sockaddr_l2 is %d bytes, want 14", size)
+	}
+}
@@ -0,0 +1,107 @@
+package l2cap
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Conn is an L2CAP connection, it implements net.Conn. Each Read and Write
+// is one packet. Blocked calls park the goroutine on the runtime network
+// poller, honor deadlines, and return when the connection is closed from
+// another goroutine.
+type Conn struct {
+	f     *os.File
+	rc    syscall.RawConn
+	laddr *Addr
+	raddr *Addr
+}
+
+func newConn(fd int, raddr *Addr) (*Conn, error) {
+	f, rc, err := newFile(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{f: f, rc: rc, raddr: raddr}, nil
+}
+
+// FileConn returns a connection on the socket file descriptor, e.g. one
+// passed by BlueZ to org.bluez.Profile1.NewConnection. The connection owns
+// the file descriptor, which is put in non-blocking mode.
+func FileConn(fd int) (*Conn, error) {
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(err, "failed to set non-blocking mode")
+	}
+
+	laddr, err := getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(err, "failed in getsockname")
+	}
+
+	raddr, err := getpeername(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(err, "failed in getpeername")
+	}
+
+	c, err := newConn(fd, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c.laddr = laddr
+	return c, nil
+}
+
+// Read reads a packet, it blocks until a packet arrives, the read deadline
+// expires or the connection is closed
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.f.Read(b)
+}
+
+// Write writes a packet, it blocks while the send buffer is full, until the
+// write deadline expires or the connection is closed
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.f.Write(b)
+}
+
+// Close closes the connection, blocked calls on it return with an error
+func (c *Conn) Close() error {
+	return c.f.Close()
+}
+
+// LocalAddr returns the address of the local adapter
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr returns the address of the remote device
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.f.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of Read
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.f.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of Write
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.f.SetWriteDeadline(t)
+}
+
+// SyscallConn returns the raw connection, for non-blocking calls on the
+// socket
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	return c.rc, nil
+}
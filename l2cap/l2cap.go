@@ -0,0 +1,271 @@
+// Package l2cap provides L2CAP sockets of the Linux bluetooth stack, with
+// connections and listeners compatible with net.Conn and net.Listener. All
+// sockets are managed by the runtime network poller.
+package l2cap
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	btprotoL2CAP = 0
+	network      = "l2cap"
+)
+
+type socklen uint32
+
+// rawSockaddrL2 is struct sockaddr_l2
+type rawSockaddrL2 struct {
+	Family     uint16
+	PSM        uint16
+	Bdaddr     [6]uint8
+	CID        uint16
+	BdaddrType uint8
+	_          uint8
+}
+
+func (a *Addr) sockaddr() rawSockaddrL2 {
+	return rawSockaddrL2{
+		Family: syscall.AF_BLUETOOTH,
+		PSM:    a.PSM,
+		Bdaddr: a.BDAddr.raw(),
+	}
+}
+
+func addrFromRaw(rsa *rawSockaddrL2) *Addr {
+	return &Addr{
+		BDAddr: bdaddrFromRaw(rsa.Bdaddr),
+		PSM:    rsa.PSM,
+	}
+}
+
+func socket() (int, error) {
+	// RFCOMM = SOCK_STREAM, L2CAP = SOCK_SEQPACKET, HCI = SOCK_RAW
+	fd, err := syscall.Socket(
+		syscall.AF_BLUETOOTH,
+		syscall.SOCK_SEQPACKET|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC,
+		btprotoL2CAP,
+	)
+	return fd, errors.Wrap(err, "socket could not be created")
+}
+
+// sockaddrCall calls bind or connect, since golang's standard libs don't
+// know L2CAP socket addresses
+func sockaddrCall(trap uintptr, fd int, a *Addr) error {
+	rsa := a.sockaddr()
+	_, _, err := syscall.Syscall(
+		trap,
+		uintptr(fd),
+		uintptr(unsafe.Pointer(&rsa)),
+		unsafe.Sizeof(rsa),
+	)
+	if err != 0 {
+		return err
+	}
+	return nil
+}
+
+func getsockname(fd int) (*Addr, error) {
+	return sockaddrOf(syscall.SYS_GETSOCKNAME, fd)
+}
+
+func getpeername(fd int) (*Addr, error) {
+	return sockaddrOf(syscall.SYS_GETPEERNAME, fd)
+}
+
+func sockaddrOf(trap uintptr, fd int) (*Addr, error) {
+	var rsa rawSockaddrL2
+	l := socklen(unsafe.Sizeof(rsa))
+	_, _, err := syscall.RawSyscall(
+		trap,
+		uintptr(fd),
+		uintptr(unsafe.Pointer(&rsa)),
+		uintptr(unsafe.Pointer(&l)),
+	)
+	if err != 0 {
+		return nil, err
+	}
+	return addrFromRaw(&rsa), nil
+}
+
+// parseAdapter parses the address of a local adapter, an empty address
+// means any adapter
+func parseAdapter(s string) (BDAddr, error) {
+	if s == "" {
+		return BDAddrAny, nil
+	}
+	return ParseBDAddr(s)
+}
+
+// Listen listens on the PSM of the local adapter, an empty adapter address
+// listens on all adapters
+func Listen(adapterAddr string, psm uint16) (*Listener, error) {
+	bdaddr, err := parseAdapter(adapterAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := socket()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := &Addr{BDAddr: bdaddr, PSM: psm}
+	if err := sockaddrCall(syscall.SYS_BIND, fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrapf(err, "failed to bind %s", addr)
+	}
+
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrapf(err, "failed to listen on %s", addr)
+	}
+
+	f, rc, err := newFile(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{f: f, rc: rc, addr: addr}, nil
+}
+
+// Dial connects to the PSM of the remote device
+func Dial(remoteAddr string, psm uint16) (*Conn, error) {
+	bdaddr, err := ParseBDAddr(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := socket()
+	if err != nil {
+		return nil, err
+	}
+
+	raddr := &Addr{BDAddr: bdaddr, PSM: psm}
+	err = sockaddrCall(syscall.SYS_CONNECT, fd, raddr)
+	if err != nil && err != syscall.EINPROGRESS {
+		syscall.Close(fd)
+		return nil, errors.Wrapf(err, "failed to connect %s", raddr)
+	}
+
+	c, err := newConn(fd, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the connection is established when the socket is writable
+	polled := false
+	var serr error
+	if err := c.rc.Write(func(fd uintptr) bool {
+		if !polled {
+			polled = true
+			return false
+		}
+
+		n, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		switch {
+		case err != nil:
+			serr = err
+		case n == int(syscall.EINPROGRESS), n == int(syscall.EALREADY):
+			return false
+		case n != 0:
+			serr = syscall.Errno(n)
+		}
+		return true
+	}); err != nil {
+		serr = err
+	}
+
+	if serr != nil {
+		c.Close()
+		return nil, errors.Wrapf(serr, "failed to connect %s", raddr)
+	}
+
+	c.laddr, _ = getsockname(fd)
+	return c, nil
+}
+
+func newFile(fd int) (*os.File, syscall.RawConn, error) {
+	f := os.NewFile(uintptr(fd), network)
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "failed to get raw connection")
+	}
+	return f, rc, nil
+}
+
+// Listener is an L2CAP listener, it implements net.Listener
+type Listener struct {
+	f    *os.File
+	rc   syscall.RawConn
+	addr *Addr
+}
+
+// Accept waits for the next connection, it implements net.Listener
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.AcceptL2CAP()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AcceptL2CAP waits for the next connection, it's safe to call from several
+// goroutines
+func (l *Listener) AcceptL2CAP() (*Conn, error) {
+	var nfd int
+	var rsa rawSockaddrL2
+	var err error
+
+	// the callback is called again when the socket is readable
+	if rerr := l.rc.Read(func(fd uintptr) bool {
+		size := socklen(unsafe.Sizeof(rsa))
+		r, _, errno := syscall.Syscall6(
+			syscall.SYS_ACCEPT4,
+			fd,
+			uintptr(unsafe.Pointer(&rsa)),
+			uintptr(unsafe.Pointer(&size)),
+			syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC,
+			0, 0,
+		)
+
+		switch errno {
+		case 0:
+			nfd = int(r)
+		case syscall.EAGAIN, syscall.ECONNABORTED:
+			return false
+		default:
+			err = errno
+		}
+		return true
+	}); rerr != nil {
+		return nil, rerr
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to accept")
+	}
+
+	c, err := newConn(nfd, addrFromRaw(&rsa))
+	if err != nil {
+		return nil, err
+	}
+	c.laddr, _ = getsockname(nfd)
+	return c, nil
+}
+
+// Addr returns the address the listener is bound to
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close closes the listener, a blocked Accept returns with an error
+func (l *Listener) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,328 @@
+package l2cap
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Unix sockets in packet mode stand in for L2CAP sockets, which need a
+// bluetooth adapter. They're wrapped like the ones of the L2CAP socket
+// calls, so they go through the same runtime network poller.
+
+const unixPacket = syscall.SOCK_SEQPACKET | syscall.SOCK_NONBLOCK | syscall.SOCK_CLOEXEC
+
+// connPair returns the connections of both ends of a socket pair
+func connPair(t *testing.T) (*Conn, *Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, unixPacket, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newConn(fds[0], &Addr{PSM: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newConn(fds[1], &Addr{PSM: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+var listenerCount int32
+
+// listenUnix returns a listener on an abstract unix socket, along with a
+// function to connect to it
+func listenUnix(t *testing.T) (*Listener, func() (*Conn, error)) {
+	name := fmt.Sprintf("@btk-l2cap-test-%d-%d", os.Getpid(), atomic.AddInt32(&listenerCount, 1))
+
+	fd, err := syscall.Socket(syscall.AF_UNIX, unixPacket, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		t.Fatal(err)
+	}
+
+	f, rc, err := newFile(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func() (*Conn, error) {
+		fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+		// the syscall package writes to the address, so each dial has its own
+		if err := syscall.Connect(fd, &syscall.SockaddrUnix{Name: name}); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+		return newConn(fd, &Addr{PSM: 1})
+	}
+
+	return &Listener{f: f, rc: rc, addr: &Addr{PSM: 1}}, dial
+}
+
+// waitGroup waits for the goroutines, or fails the test if they're stuck
+func waitGroup(t *testing.T, wg *sync.WaitGroup, what string) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s still blocked", what)
+	}
+}
+
+func TestConnPackets(t *testing.T) {
+	a, b := connPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	packets := [][]byte{{0xa1, 0x00}, {0xa1, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00}, {0x71}}
+	for _, p := range packets {
+		if _, err := a.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each read is one packet
+	for _, p := range packets {
+		r := make([]byte, 64)
+		n, err := b.Read(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(r[:n], p) {
+			t.Errorf("read %x, want %x", r[:n], p)
+		}
+	}
+}
+
+func TestConnCloseUnblocks(t *testing.T) {
+	a, b := connPair(t)
+
+	// fill the send buffer, so the next write blocks
+	if err := a.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := a.Write(make([]byte, 1024)); err != nil {
+			break
+		}
+	}
+	if err := a.SetWriteDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := a.Write([]byte{0x01}); err == nil {
+			t.Error("write on closed connection succeeded")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// nothing is ever written by b, so a has nothing to read
+		if _, err := a.Read(make([]byte, 64)); err == nil {
+			t.Error("read on closed connection succeeded")
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	a.Close()
+	waitGroup(t, &wg, "read and write")
+	b.Close()
+}
+
+func TestConnConcurrentReadWrite(t *testing.T) {
+	a, b := connPair(t)
+	defer b.Close()
+
+	const writers, packets = 4, 200
+
+	var received int32
+	var readers sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			r := make([]byte, 64)
+			for {
+				n, err := b.Read(r)
+				if err != nil || n == 0 {
+					return
+				}
+				if n != 2 {
+					t.Errorf("read packet of %d bytes, want 2", n)
+				}
+				atomic.AddInt32(&received, 1)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < packets; j++ {
+				if _, err := a.Write([]byte{uint8(i), uint8(j)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	waitGroup(t, &wg, "writers")
+	// readers get EOF once all packets are read
+	a.Close()
+	waitGroup(t, &readers, "readers")
+
+	if n := atomic.LoadInt32(&received); n != writers*packets {
+		t.Errorf("received %d packets, want %d", n, writers*packets)
+	}
+}
+
+func TestConnConcurrentClose(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		a, b := connPair(t)
+
+		var wg sync.WaitGroup
+		for _, c := range []*Conn{a, b} {
+			for i := 0; i < 2; i++ {
+				wg.Add(2)
+				go func(c *Conn) {
+					defer wg.Done()
+					r := make([]byte, 64)
+					for {
+						if _, err := c.Read(r); err != nil {
+							return
+						}
+					}
+				}(c)
+				go func(c *Conn) {
+					defer wg.Done()
+					for {
+						if _, err := c.Write([]byte{0xa1, 0x00}); err != nil {
+							return
+						}
+					}
+				}(c)
+			}
+		}
+
+		// close both ends from several goroutines while they're in use
+		time.Sleep(time.Duration(round) * time.Millisecond)
+		for i := 0; i < 2; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				a.Close()
+			}()
+			go func() {
+				defer wg.Done()
+				b.Close()
+			}()
+		}
+
+		waitGroup(t, &wg, "connections")
+	}
+}
+
+func TestListenerConcurrentAccept(t *testing.T) {
+	l, dial := listenUnix(t)
+
+	const acceptors, clients = 4, 32
+
+	var echoes sync.WaitGroup
+	var accepted sync.WaitGroup
+	for i := 0; i < acceptors; i++ {
+		accepted.Add(1)
+		go func() {
+			defer accepted.Done()
+			for {
+				c, err := l.AcceptL2CAP()
+				if err != nil {
+					return
+				}
+
+				echoes.Add(1)
+				go func() {
+					defer echoes.Done()
+					defer c.Close()
+
+					r := make([]byte, 64)
+					n, err := c.Read(r)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err := c.Write(r[:n]); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			c, err := dial()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+
+			p := []byte{0xa1, uint8(i)}
+			if _, err := c.Write(p); err != nil {
+				t.Error(err)
+				return
+			}
+
+			r := make([]byte, 64)
+			n, err := c.Read(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(r[:n], p) {
+				t.Errorf("echoed %x, want %x", r[:n], p)
+			}
+		}(i)
+	}
+
+	waitGroup(t, &wg, "clients")
+
+	// blocked accepts return when the listener is closed
+	l.Close()
+	waitGroup(t, &accepted, "accepts")
+	waitGroup(t, &echoes, "echoes")
+}
@@ -0,0 +1,239 @@
+package l2cap
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Socket options from the kernel headers bluetooth.h and l2cap.h
+const (
+	solBluetooth = 274
+	solL2CAP     = 6
+
+	btSecurity  = 4
+	btFlushable = 8
+	btPower     = 9
+
+	l2capOptions  = 0x01
+	l2capConnInfo = 0x02
+)
+
+// SecurityLevel is the security level of a bluetooth connection
+type SecurityLevel uint8
+
+// Security levels
+const (
+	// SecuritySDP is only allowed for SDP
+	SecuritySDP SecurityLevel = iota
+	// SecurityLow means no encryption
+	SecurityLow
+	// SecurityMedium requires an encrypted link
+	SecurityMedium
+	// SecurityHigh requires an encrypted and authenticated link, i.e.
+	// with MITM protection
+	SecurityHigh
+	// SecurityFIPS requires secure connections only
+	SecurityFIPS
+)
+
+func (l SecurityLevel) String() string {
+	switch l {
+	case SecuritySDP:
+		return "sdp"
+	case SecurityLow:
+		return "low"
+	case SecurityMedium:
+		return "medium"
+	case SecurityHigh:
+		return "high"
+	case SecurityFIPS:
+		return "fips"
+	}
+	return fmt.Sprintf("security(%d)", uint8(l))
+}
+
+// Security is the BT_SECURITY socket option, struct bt_security
+type Security struct {
+	Level   SecurityLevel
+	KeySize uint8
+}
+
+// Mode is the L2CAP channel mode
+type Mode uint8
+
+// L2CAP channel modes
+const (
+	ModeBasic Mode = iota
+	ModeRetransmission
+	ModeFlowControl
+	ModeERTM
+	ModeStreaming
+)
+
+// Options is the L2CAP_OPTIONS socket option, struct l2cap_options
+type Options struct {
+	// OMTU and IMTU are the outgoing and incoming MTU
+	OMTU         uint16
+	IMTU         uint16
+	FlushTimeout uint16
+	Mode         Mode
+	FCS          uint8
+	MaxTx        uint8
+	_            uint8
+	TxWindow     uint16
+}
+
+// ConnInfo is the L2CAP_CONNINFO socket option, struct l2cap_conninfo
+type ConnInfo struct {
+	HCIHandle uint16
+	DevClass  [3]uint8
+	_         uint8
+}
+
+type bluetoothPower struct {
+	ForceActive uint8
+}
+
+// sockopt gets and sets socket options of a raw connection
+type sockopt struct {
+	rc syscall.RawConn
+}
+
+func (s sockopt) get(level, name int, v unsafe.Pointer, size uintptr) error {
+	l := socklen(size)
+	return s.call(func(fd uintptr) syscall.Errno {
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_GETSOCKOPT,
+			fd, uintptr(level), uintptr(name),
+			uintptr(v), uintptr(unsafe.Pointer(&l)), 0,
+		)
+		return errno
+	})
+}
+
+func (s sockopt) set(level, name int, v unsafe.Pointer, size uintptr) error {
+	return s.call(func(fd uintptr) syscall.Errno {
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_SETSOCKOPT,
+			fd, uintptr(level), uintptr(name),
+			uintptr(v), size, 0,
+		)
+		return errno
+	})
+}
+
+func (s sockopt) call(f func(fd uintptr) syscall.Errno) error {
+	var errno syscall.Errno
+	if err := s.rc.Control(func(fd uintptr) {
+		errno = f(fd)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (s sockopt) security() (Security, error) {
+	var v Security
+	err := s.get(solBluetooth, btSecurity, unsafe.Pointer(&v), unsafe.Sizeof(v))
+	return v, errors.Wrap(err, "failed to get BT_SECURITY")
+}
+
+func (s sockopt) setSecurity(level SecurityLevel) error {
+	v := Security{Level: level}
+	err := s.set(solBluetooth, btSecurity, unsafe.Pointer(&v), unsafe.Sizeof(v))
+	return errors.Wrap(err, "failed to set BT_SECURITY")
+}
+
+func (s sockopt) options() (Options, error) {
+	var v Options
+	err := s.get(solL2CAP, l2capOptions, unsafe.Pointer(&v), unsafe.Sizeof(v))
+	return v, errors.Wrap(err, "failed to get L2CAP_OPTIONS")
+}
+
+func (s sockopt) setOptions(v Options) error {
+	err := s.set(solL2CAP, l2capOptions, unsafe.Pointer(&v), unsafe.Sizeof(v))
+	return errors.Wrap(err, "failed to set L2CAP_OPTIONS")
+}
+
+// Security returns the security level of the connection
+func (c *Conn) Security() (Security, error) {
+	return sockopt{c.rc}.security()
+}
+
+// SetSecurity sets the security level of the connection, raising it on an
+// established link starts encryption or authentication
+func (c *Conn) SetSecurity(level SecurityLevel) error {
+	return sockopt{c.rc}.setSecurity(level)
+}
+
+// Options returns the L2CAP options of the connection, e.g. the MTU
+// negotiated with the remote device
+func (c *Conn) Options() (Options, error) {
+	return sockopt{c.rc}.options()
+}
+
+// SetOptions sets the L2CAP options of the connection
+func (c *Conn) SetOptions(v Options) error {
+	return sockopt{c.rc}.setOptions(v)
+}
+
+// Flushable tells if packets of the connection can be flushed, i.e. dropped
+// when they can't be delivered within the flush timeout
+func (c *Conn) Flushable() (bool, error) {
+	var v uint32
+	err := sockopt{c.rc}.get(solBluetooth, btFlushable, unsafe.Pointer(&v), unsafe.Sizeof(v))
+	return v != 0, errors.Wrap(err, "failed to get BT_FLUSHABLE")
+}
+
+// SetFlushable sets if packets of the connection can be flushed
+func (c *Conn) SetFlushable(flushable bool) error {
+	var v uint32
+	if flushable {
+		v = 1
+	}
+	err := sockopt{c.rc}.set(solBluetooth, btFlushable, unsafe.Pointer(&v), unsafe.Sizeof(v))
+	return errors.Wrap(err, "failed to set BT_FLUSHABLE")
+}
+
+// Power tells if the link is forced to the active mode while sending, i.e.
+// out of sniff mode
+func (c *Conn) Power() (bool, error) {
+	var v bluetoothPower
+	err := sockopt{c.rc}.get(solBluetooth, btPower, unsafe.Pointer(&v), unsafe.Sizeof(v))
+	return v.ForceActive != 0, errors.Wrap(err, "failed to get BT_POWER")
+}
+
+// SetPower sets if the link is forced to the active mode while sending
+func (c *Conn) SetPower(forceActive bool) error {
+	var v bluetoothPower
+	if forceActive {
+		v.ForceActive = 1
+	}
+	err := sockopt{c.rc}.set(solBluetooth, btPower, unsafe.Pointer(&v), unsafe.Sizeof(v))
+	return errors.Wrap(err, "failed to set BT_POWER")
+}
+
+// ConnInfo returns the HCI handle and the device class of the link
+func (c *Conn) ConnInfo() (ConnInfo, error) {
+	var v ConnInfo
+	err := sockopt{c.rc}.get(solL2CAP, l2capConnInfo, unsafe.Pointer(&v), unsafe.Sizeof(v))
+	return v, errors.Wrap(err, "failed to get L2CAP_CONNINFO")
+}
+
+// SetSecurity sets the security level of connections accepted by the
+// listener, the link must reach the level before they are accepted
+func (l *Listener) SetSecurity(level SecurityLevel) error {
+	return sockopt{l.rc}.setSecurity(level)
+}
+
+// SetOptions sets the L2CAP options of connections accepted by the
+// listener
+func (l *Listener) SetOptions(v Options) error {
+	return sockopt{l.rc}.setOptions(v)
+}
@@ -0,0 +1,51 @@
+package l2cap
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestSockoptLayouts(t *testing.T) {
+	// sizes and offsets of the structs in <bluetooth/bluetooth.h> and
+	// <bluetooth/l2cap.h>
+	tests := []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"sizeof(struct bt_security)", unsafe.Sizeof(Security{}), 2},
+		{"bt_security.key_size", unsafe.Offsetof(Security{}.KeySize), 1},
+		{"sizeof(struct bt_power)", unsafe.Sizeof(bluetoothPower{}), 1},
+		{"sizeof(struct l2cap_options)", unsafe.Sizeof(Options{}), 12},
+		{"l2cap_options.flush_to", unsafe.Offsetof(Options{}.FlushTimeout), 4},
+		{"l2cap_options.mode", unsafe.Offsetof(Options{}.Mode), 6},
+		{"l2cap_options.max_tx", unsafe.Offsetof(Options{}.MaxTx), 8},
+		{"l2cap_options.txwin_size", unsafe.Offsetof(Options{}.TxWindow), 10},
+		{"sizeof(struct l2cap_conninfo)", unsafe.Sizeof(ConnInfo{}), 6},
+		{"l2cap_conninfo.dev_class", unsafe.Offsetof(ConnInfo{}.DevClass), 2},
+	}
+
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s is %d, want %d", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestSecurityLevelString(t *testing.T) {
+	tests := []struct {
+		level SecurityLevel
+		s     string
+	}{
+		{SecuritySDP, "sdp"},
+		{SecurityMedium, "medium"},
+		{SecurityFIPS, "fips"},
+		{SecurityLevel(9), "security(9)"},
+	}
+
+	for _, test := range tests {
+		if s := test.level.String(); s != test.s {
+			t.Errorf("SecurityLevel(%d).String() = %q, want %q", uint8(test.level), s, test.s)
+		}
+	}
+}
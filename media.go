@@ -0,0 +1,215 @@
+package btk
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// mediaDesc is the HID descriptor of media keys, report 1 is consumer control
+// with two slots of consumer usages, and report 2 is system control with
+// power down, sleep and wake up
+var mediaDesc = []byte{
+	0x05, 0x0c, // Usage Page (Consumer)
+	0x09, 0x01, // Usage (Consumer Control)
+	0xa1, 0x01, // Collection (Application)
+	0x85, 0x01, //   Report ID (1)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x03, //   Logical Maximum (1023)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x2a, 0xff, 0x03, //   Usage Maximum (1023)
+	0x75, 0x10, //   Report Size (16)
+	0x95, 0x02, //   Report Count (2)
+	0x81, 0x00, //   Input (Data, Array, Absolute)
+	0xc0,       // End Collection
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x80, // Usage (System Control)
+	0xa1, 0x01, // Collection (Application)
+	0x85, 0x02, //   Report ID (2)
+	0x19, 0x81, //   Usage Minimum (System Power Down)
+	0x29, 0x83, //   Usage Maximum (System Wake Up)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x03, //   Report Count (3)
+	0x81, 0x02, //   Input (Data, Variable, Absolute)
+	0x95, 0x05, //   Report Count (5)
+	0x81, 0x01, //   Input (Constant)
+	0xc0, // End Collection
+}
+
+const (
+	mediaConsumerID = 1
+	mediaSystemID   = 2
+
+	usageSystemPowerDown = pageGenericDesktop<<16 | 0x81
+	usageSystemWakeUp    = pageGenericDesktop<<16 | 0x83
+)
+
+var media = mustParseDesc(mediaDesc)
+
+func isSystemControl(u usage) bool {
+	return u >= usageSystemPowerDown && u <= usageSystemWakeUp
+}
+
+// MediaSource is an InputSource translating media keys of any device, i.e.
+// usages on the consumer page like volume and play/pause, and system
+// control like sleep, into reports of mediaDesc. Media keys usually live on
+// a separate interface of a usb keyboard.
+type MediaSource struct {
+	in     *fanIn
+	inputs []*mediaInput
+
+	mu sync.Mutex
+	// consumer and system are the usages reported last time
+	consumer []usageValue
+	system   []usageValue
+	pending  [][]byte
+}
+
+type mediaInput struct {
+	desc *reportDesc
+	// consumer and system are the pressed keys of each report ID
+	consumer map[uint8][]usageValue
+	system   map[uint8][]usageValue
+}
+
+// NewMediaSource returns a MediaSource on the given sources, their
+// descriptors must have consumer or system control usages
+func NewMediaSource(sources ...InputSource) (*MediaSource, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no media keys")
+	}
+
+	s := &MediaSource{}
+
+	for _, src := range sources {
+		desc, err := parseDesc(src.Desc())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse HID descriptor")
+		}
+
+		if !hasMediaKeys(desc) {
+			return nil, errors.New("input source has no media keys")
+		}
+
+		s.inputs = append(s.inputs, &mediaInput{
+			desc:     desc,
+			consumer: make(map[uint8][]usageValue),
+			system:   make(map[uint8][]usageValue),
+		})
+	}
+
+	s.in = newFanIn(sources)
+
+	return s, nil
+}
+
+func hasMediaKeys(desc *reportDesc) bool {
+	for _, f := range desc.fields {
+		if f.typ != reportInput || f.isConstant() {
+			continue
+		}
+		if f.hasUsagePage(pageConsumer) || f.hasUsage(usageSystemPowerDown) {
+			return true
+		}
+	}
+	return false
+}
+
+// Desc returns mediaDesc
+func (s *MediaSource) Desc() []byte {
+	return mediaDesc
+}
+
+// ReadReport returns a consumer or system control report when the pressed
+// media keys change
+func (s *MediaSource) ReadReport() ([]byte, error) {
+	for {
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			r := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+			return r, nil
+		}
+		s.mu.Unlock()
+
+		i, report, gone, err := s.in.next()
+		if err != nil {
+			return nil, err
+		}
+
+		in := s.inputs[i]
+
+		s.mu.Lock()
+		if gone != nil {
+			logrus.WithError(gone).Warnln("Media keys gone")
+			in.consumer = map[uint8][]usageValue{}
+			in.system = map[uint8][]usageValue{}
+		} else {
+			id, _ := in.desc.reportPayload(report)
+			in.consumer[id], in.system[id] = nil, nil
+
+			for _, v := range in.desc.values(reportInput, report) {
+				switch {
+				case v.value == 0:
+				case v.usage.page() == pageConsumer:
+					in.consumer[id] = append(in.consumer[id], usageValue{v.usage, 1})
+				case isSystemControl(v.usage):
+					in.system[id] = append(in.system[id], usageValue{v.usage, 1})
+				}
+			}
+		}
+		s.update()
+		s.mu.Unlock()
+	}
+}
+
+// update queues reports of the pressed media keys of all inputs if they're
+// changed
+func (s *MediaSource) update() {
+	var consumer, system []usageValue
+	for _, in := range s.inputs {
+		for _, values := range in.consumer {
+			consumer = append(consumer, values...)
+		}
+		for _, values := range in.system {
+			system = append(system, values...)
+		}
+	}
+
+	if !sameUsages(consumer, s.consumer) {
+		s.consumer = consumer
+		s.pending = append(s.pending, media.encode(reportInput, mediaConsumerID, consumer))
+	}
+
+	if !sameUsages(system, s.system) {
+		s.system = system
+		s.pending = append(s.pending, media.encode(reportInput, mediaSystemID, system))
+	}
+}
+
+func sameUsages(a, b []usageValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	set := map[usage]bool{}
+	for _, v := range a {
+		set[v.usage] = true
+	}
+	for _, v := range b {
+		if !set[v.usage] {
+			return false
+		}
+	}
+	return true
+}
+
+// Close closes all the sources
+func (s *MediaSource) Close() error {
+	s.in.close()
+	return nil
+}
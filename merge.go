@@ -0,0 +1,133 @@
+package btk
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// MergedSource is an InputSource merging several keyboards into one boot
+// keyboard, e.g. the halves of a split keyboard and a numpad. Reports of
+// the keyboards are decoded with their own descriptors, and the pressed keys
+// of all keyboards are reported together.
+type MergedSource struct {
+	in     *fanIn
+	inputs []*mergedInput
+
+	mu    sync.Mutex
+	state keyState
+}
+
+type mergedInput struct {
+	src  InputSource
+	desc *reportDesc
+	held heldKeys
+}
+
+// NewMergedSource returns a MergedSource on the given sources, their
+// descriptors must describe keyboards
+func NewMergedSource(sources ...InputSource) (*MergedSource, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no keyboard to merge")
+	}
+
+	s := &MergedSource{}
+
+	for _, src := range sources {
+		desc, err := parseDesc(src.Desc())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse HID descriptor")
+		}
+
+		if _, ok := desc.findReport(reportInput, pageKeyboard); !ok {
+			return nil, errors.New("input source is not a keyboard")
+		}
+
+		s.inputs = append(s.inputs, &mergedInput{
+			src:  src,
+			desc: desc,
+			held: heldKeys{},
+		})
+	}
+
+	s.in = newFanIn(sources)
+
+	return s, nil
+}
+
+// Desc returns the descriptor of a boot keyboard
+func (s *MergedSource) Desc() []byte {
+	return bootKeyboardDesc
+}
+
+// ReadReport returns a boot keyboard report when the pressed keys of any
+// keyboard change. An error is returned as soon as any keyboard is gone, so
+// the whole set is opened again, keyboards which should be replugged on their
+// own are to be wrapped in ReopeningSource.
+func (s *MergedSource) ReadReport() ([]byte, error) {
+	for {
+		i, report, gone, err := s.in.next()
+		if err != nil {
+			return nil, err
+		}
+		if gone != nil {
+			return nil, errors.Wrap(gone, "merged keyboard gone")
+		}
+
+		in := s.inputs[i]
+
+		s.mu.Lock()
+
+		if !in.held.update(in.desc, report) {
+			s.mu.Unlock()
+			continue
+		}
+
+		changed := s.update()
+		report = s.state.bootReport()
+		s.mu.Unlock()
+
+		if changed {
+			return report, nil
+		}
+	}
+}
+
+// update applies the union of pressed keys of all keyboards to the state
+func (s *MergedSource) update() bool {
+	held := map[uint8]bool{}
+	for _, in := range s.inputs {
+		in.held.union(held)
+	}
+
+	return s.state.set(held)
+}
+
+// WriteReport sets the LEDs of all keyboards from a boot keyboard output
+// report
+func (s *MergedSource) WriteReport(report []byte) error {
+	if len(report) < 1 {
+		return nil
+	}
+
+	leds := ledValues(report[0])
+
+	var err error
+	for _, in := range s.inputs {
+		id, ok := in.desc.findReport(reportOutput, pageLED)
+		if !ok {
+			continue
+		}
+
+		if e := writeOutput(in.src, in.desc.encode(reportOutput, id, leds)); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close closes all the keyboards
+func (s *MergedSource) Close() error {
+	s.in.close()
+	return nil
+}
@@ -0,0 +1,77 @@
+package btk
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMergedSourceReplug(t *testing.T) {
+	left := NewMemorySource(bootKeyboardDesc)
+	right := NewMemorySource(bootKeyboardDesc)
+	replugged := make(chan InputSource, 1)
+
+	reopenLeft, err := NewReopeningSource(bootKeyboardDesc, left, func() (InputSource, error) {
+		select {
+		case src := <-replugged:
+			return src, nil
+		default:
+			return nil, errSourceAbsent
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewMergedSource(reopenLeft, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	go left.Send(bootKeys(0x04))
+	if r := readReport(t, s); !bytes.Equal(r, bootKeys(0x04)) {
+		t.Fatalf("report is %v, want a pressed", r)
+	}
+
+	if err := s.WriteReport([]byte{0x02}); err != nil {
+		t.Fatal(err)
+	}
+
+	// unplugging the left half releases its keys
+	newLeft := NewMemorySource(bootKeyboardDesc)
+	replugged <- newLeft
+	left.Close()
+	if r := readReport(t, s); !bytes.Equal(r, bootKeys()) {
+		t.Fatalf("report is %v, want all released", r)
+	}
+
+	go right.Send(bootKeys(0x05))
+	if r := readReport(t, s); !bytes.Equal(r, bootKeys(0x05)) {
+		t.Fatalf("report is %v, want b pressed", r)
+	}
+
+	go newLeft.Send(bootKeys(0x06))
+	if r := readReport(t, s); !bytes.Equal(r, bootKeys(0x05, 0x06)) {
+		t.Fatalf("report is %v, want b and c pressed", r)
+	}
+
+	if out := newLeft.Outputs(); len(out) != 1 || !bytes.Equal(out[0], []byte{0x02}) {
+		t.Errorf("outputs of the replugged half are %v, want the LEDs set again", out)
+	}
+}
+
+func TestMergedSourceGone(t *testing.T) {
+	left := NewMemorySource(bootKeyboardDesc)
+	right := NewMemorySource(bootKeyboardDesc)
+
+	s, err := NewMergedSource(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	left.Close()
+	if _, err := s.ReadReport(); err == nil {
+		t.Fatal("no error when a keyboard is gone")
+	}
+}
@@ -0,0 +1,291 @@
+package btk
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// TransType is the transaction type of a HIDP message, i.e. the high 4 bits
+// of the message header
+type TransType uint8
+
+// HIDP transaction types, see the Bluetooth HID profile spec 3.1.1
+const (
+	TransHandshake   TransType = 0x0
+	TransHIDControl  TransType = 0x1
+	TransGetReport   TransType = 0x4
+	TransSetReport   TransType = 0x5
+	TransGetProtocol TransType = 0x6
+	TransSetProtocol TransType = 0x7
+	// TransGetIdle, TransSetIdle and TransDatc are deprecated since HID
+	// profile 1.1
+	TransGetIdle TransType = 0x8
+	TransSetIdle TransType = 0x9
+	TransData    TransType = 0xa
+	TransDatc    TransType = 0xb
+)
+
+var transNames = map[TransType]string{
+	TransHandshake:   "HANDSHAKE",
+	TransHIDControl:  "HID_CONTROL",
+	TransGetReport:   "GET_REPORT",
+	TransSetReport:   "SET_REPORT",
+	TransGetProtocol: "GET_PROTOCOL",
+	TransSetProtocol: "SET_PROTOCOL",
+	TransGetIdle:     "GET_IDLE",
+	TransSetIdle:     "SET_IDLE",
+	TransData:        "DATA",
+	TransDatc:        "DATC",
+}
+
+func (t TransType) String() string {
+	if name, ok := transNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TRANS(%#x)", uint8(t))
+}
+
+// HandshakeResult is the parameter of a HANDSHAKE message
+type HandshakeResult uint8
+
+// HANDSHAKE result codes
+const (
+	HandshakeSuccessful            HandshakeResult = 0x0
+	HandshakeNotReady              HandshakeResult = 0x1
+	HandshakeErrInvalidReportID    HandshakeResult = 0x2
+	HandshakeErrUnsupportedRequest HandshakeResult = 0x3
+	HandshakeErrInvalidParameter   HandshakeResult = 0x4
+	HandshakeErrUnknown            HandshakeResult = 0xe
+	HandshakeErrFatal              HandshakeResult = 0xf
+)
+
+var handshakeNames = map[HandshakeResult]string{
+	HandshakeSuccessful:            "SUCCESSFUL",
+	HandshakeNotReady:              "NOT_READY",
+	HandshakeErrInvalidReportID:    "ERR_INVALID_REPORT_ID",
+	HandshakeErrUnsupportedRequest: "ERR_UNSUPPORTED_REQUEST",
+	HandshakeErrInvalidParameter:   "ERR_INVALID_PARAMETER",
+	HandshakeErrUnknown:            "ERR_UNKNOWN",
+	HandshakeErrFatal:              "ERR_FATAL",
+}
+
+func (r HandshakeResult) String() string {
+	if name, ok := handshakeNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("HANDSHAKE(%#x)", uint8(r))
+}
+
+// ControlOp is the parameter of a HID_CONTROL message
+type ControlOp uint8
+
+// HID_CONTROL operations, hard and soft reset are deprecated since HID
+// profile 1.1
+const (
+	ControlNop                ControlOp = 0x0
+	ControlHardReset          ControlOp = 0x1
+	ControlSoftReset          ControlOp = 0x2
+	ControlSuspend            ControlOp = 0x3
+	ControlExitSuspend        ControlOp = 0x4
+	ControlVirtualCableUnplug ControlOp = 0x5
+)
+
+var controlNames = map[ControlOp]string{
+	ControlNop:                "NOP",
+	ControlHardReset:          "HARD_RESET",
+	ControlSoftReset:          "SOFT_RESET",
+	ControlSuspend:            "SUSPEND",
+	ControlExitSuspend:        "EXIT_SUSPEND",
+	ControlVirtualCableUnplug: "VIRTUAL_CABLE_UNPLUG",
+}
+
+func (op ControlOp) String() string {
+	if name, ok := controlNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("CONTROL(%#x)", uint8(op))
+}
+
+// ReportType is the report type parameter of GET_REPORT, SET_REPORT and DATA
+type ReportType uint8
+
+// Report types
+const (
+	ReportOther   ReportType = 0x0
+	ReportInput   ReportType = 0x1
+	ReportOutput  ReportType = 0x2
+	ReportFeature ReportType = 0x3
+)
+
+func (t ReportType) String() string {
+	switch t {
+	case ReportOther:
+		return "other"
+	case ReportInput:
+		return "input"
+	case ReportOutput:
+		return "output"
+	case ReportFeature:
+		return "feature"
+	}
+	return fmt.Sprintf("report(%#x)", uint8(t))
+}
+
+// descType returns the main item tag of the report type in HID descriptors
+func (t ReportType) descType() uint8 {
+	switch t {
+	case ReportInput:
+		return reportInput
+	case ReportOutput:
+		return reportOutput
+	case ReportFeature:
+		return reportFeature
+	}
+	return 0
+}
+
+// Protocol is the protocol mode of GET_PROTOCOL and SET_PROTOCOL
+type Protocol uint8
+
+// Protocol modes
+const (
+	ProtocolBoot   Protocol = 0x0
+	ProtocolReport Protocol = 0x1
+)
+
+func (p Protocol) String() string {
+	if p == ProtocolBoot {
+		return "boot"
+	}
+	return "report"
+}
+
+const (
+	headerTransShift = 4
+	headerParamMask  = 0x0f
+
+	reportTypeMask  = 0x03
+	getReportSize   = 0x08
+	setProtocolMask = 0x01
+)
+
+// ErrInvalidMessage is returned when decoding a malformed HIDP message
+var ErrInvalidMessage = errors.New("invalid HIDP message")
+
+// Message is a HIDP message, i.e. a header of transaction type and parameter
+// followed by the payload
+type Message struct {
+	Type  TransType
+	Param uint8
+	Data  []byte
+}
+
+// ParseMessage decodes a HIDP message
+func ParseMessage(b []byte) (Message, error) {
+	if len(b) < 1 {
+		return Message{}, ErrInvalidMessage
+	}
+
+	return Message{
+		Type:  TransType(b[0] >> headerTransShift),
+		Param: b[0] & headerParamMask,
+		Data:  b[1:],
+	}, nil
+}
+
+// Bytes encodes the message
+func (m Message) Bytes() []byte {
+	header := uint8(m.Type)<<headerTransShift | m.Param&headerParamMask
+	return append([]byte{header}, m.Data...)
+}
+
+func (m Message) String() string {
+	return fmt.Sprintf("%s(%#x) %x", m.Type, m.Param, m.Data)
+}
+
+// Handshake returns a HANDSHAKE message of the result
+func Handshake(r HandshakeResult) Message {
+	return Message{Type: TransHandshake, Param: uint8(r)}
+}
+
+// DataMessage returns a DATA message of the report
+func DataMessage(typ ReportType, report []byte) Message {
+	return Message{Type: TransData, Param: uint8(typ), Data: report}
+}
+
+// ControlMessage returns a HID_CONTROL message of the operation
+func ControlMessage(op ControlOp) Message {
+	return Message{Type: TransHIDControl, Param: uint8(op)}
+}
+
+// ReportType returns the report type of a GET_REPORT, SET_REPORT or DATA
+// message
+func (m Message) ReportType() ReportType {
+	return ReportType(m.Param & reportTypeMask)
+}
+
+// ControlOp returns the operation of a HID_CONTROL message
+func (m Message) ControlOp() ControlOp {
+	return ControlOp(m.Param)
+}
+
+// Protocol returns the protocol mode of a SET_PROTOCOL message
+func (m Message) Protocol() Protocol {
+	return Protocol(m.Param & setProtocolMask)
+}
+
+// GetReportRequest is a decoded GET_REPORT message
+type GetReportRequest struct {
+	Type ReportType
+	// ID is the requested report ID, it's 0 if the device has no report IDs
+	ID uint8
+	// BufferSize is the maximum number of bytes of the report to return,
+	// not counting the header, 0 means no limit
+	BufferSize int
+}
+
+// GetReportRequest decodes a GET_REPORT message, ids tells if the device has
+// report IDs, i.e. if the report ID is present in the message
+func (m Message) GetReportRequest(ids bool) (GetReportRequest, error) {
+	req := GetReportRequest{Type: m.ReportType()}
+	data := m.Data
+
+	if m.Type != TransGetReport || req.Type == ReportOther || m.Param&^(reportTypeMask|getReportSize) != 0 {
+		return req, ErrInvalidMessage
+	}
+
+	if ids {
+		if len(data) < 1 {
+			return req, ErrInvalidMessage
+		}
+		req.ID, data = data[0], data[1:]
+	}
+
+	if m.Param&getReportSize != 0 {
+		if len(data) < 2 {
+			return req, ErrInvalidMessage
+		}
+		req.BufferSize, data = int(data[0])|int(data[1])<<8, data[2:]
+	}
+
+	if len(data) != 0 {
+		return req, ErrInvalidMessage
+	}
+
+	return req, nil
+}
+
+// GetReportMessage returns a GET_REPORT message, ids tells if the device has
+// report IDs, a bufferSize of 0 means no limit
+func GetReportMessage(req GetReportRequest, ids bool) Message {
+	m := Message{Type: TransGetReport, Param: uint8(req.Type) & reportTypeMask}
+	if ids {
+		m.Data = append(m.Data, req.ID)
+	}
+	if req.BufferSize > 0 {
+		m.Param |= getReportSize
+		m.Data = append(m.Data, uint8(req.BufferSize), uint8(req.BufferSize>>8))
+	}
+	return m
+}
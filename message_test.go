@@ -0,0 +1,105 @@
+package btk
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		b   []byte
+		m   Message
+		err error
+	}{
+		{nil, Message{}, ErrInvalidMessage},
+		{[]byte{0x00}, Message{Type: TransHandshake, Param: 0x0, Data: []byte{}}, nil},
+		{[]byte{0x15}, Message{Type: TransHIDControl, Param: 0x5, Data: []byte{}}, nil},
+		{[]byte{0xa1, 0x00, 0x04}, Message{Type: TransData, Param: 0x1, Data: []byte{0x00, 0x04}}, nil},
+		{[]byte{0x4b, 0x01, 0x08, 0x00}, Message{Type: TransGetReport, Param: 0xb, Data: []byte{0x01, 0x08, 0x00}}, nil},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMessage(test.b)
+		if err != test.err {
+			t.Errorf("ParseMessage(%x) error %v, want %v", test.b, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if m.Type != test.m.Type || m.Param != test.m.Param || !bytes.Equal(m.Data, test.m.Data) {
+			t.Errorf("ParseMessage(%x) = %v, want %v", test.b, m, test.m)
+		}
+		if b := m.Bytes(); !bytes.Equal(b, test.b) {
+			t.Errorf("ParseMessage(%x).Bytes() = %x", test.b, b)
+		}
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	tests := []struct {
+		m Message
+		b []byte
+	}{
+		{Handshake(HandshakeErrInvalidReportID), []byte{0x02}},
+		{ControlMessage(ControlVirtualCableUnplug), []byte{0x15}},
+		{DataMessage(ReportInput, []byte{0x00, 0x04}), []byte{0xa1, 0x00, 0x04}},
+		{DataMessage(ReportOther, []byte{0x01}), []byte{0xa0, 0x01}},
+		// the parameter is only the low 4 bits of the header
+		{Message{Type: TransSetProtocol, Param: 0x11}, []byte{0x71}},
+	}
+
+	for _, test := range tests {
+		if b := test.m.Bytes(); !bytes.Equal(b, test.b) {
+			t.Errorf("%v.Bytes() = %x, want %x", test.m, b, test.b)
+		}
+	}
+}
+
+func TestGetReportRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		ids  bool
+		req  GetReportRequest
+		err  error
+	}{
+		{"input", []byte{0x41}, false, GetReportRequest{Type: ReportInput}, nil},
+		{"output", []byte{0x42}, false, GetReportRequest{Type: ReportOutput}, nil},
+		{"feature with id", []byte{0x43, 0x05}, true, GetReportRequest{Type: ReportFeature, ID: 5}, nil},
+		{"size", []byte{0x49, 0x08, 0x00}, false, GetReportRequest{Type: ReportInput, BufferSize: 8}, nil},
+		{"size with id", []byte{0x49, 0x02, 0x00, 0x01}, true, GetReportRequest{Type: ReportInput, ID: 2, BufferSize: 256}, nil},
+		{"missing id", []byte{0x41}, true, GetReportRequest{}, ErrInvalidMessage},
+		{"unexpected id", []byte{0x41, 0x01}, false, GetReportRequest{}, ErrInvalidMessage},
+		{"missing size", []byte{0x49}, false, GetReportRequest{}, ErrInvalidMessage},
+		{"short size", []byte{0x49, 0x01, 0x08}, true, GetReportRequest{}, ErrInvalidMessage},
+		{"trailing data", []byte{0x49, 0x08, 0x00, 0x00}, false, GetReportRequest{}, ErrInvalidMessage},
+		{"reserved bit", []byte{0x45}, false, GetReportRequest{}, ErrInvalidMessage},
+		{"other", []byte{0x40}, false, GetReportRequest{}, ErrInvalidMessage},
+		{"other with size", []byte{0x48, 0x08, 0x00}, false, GetReportRequest{}, ErrInvalidMessage},
+		{"not get report", []byte{0x51}, false, GetReportRequest{}, ErrInvalidMessage},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMessage(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := m.GetReportRequest(test.ids)
+		if err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if req != test.req {
+			t.Errorf("%s: request %+v, want %+v", test.name, req, test.req)
+		}
+
+		if b := GetReportMessage(req, test.ids).Bytes(); !bytes.Equal(b, test.b) {
+			t.Errorf("%s: GetReportMessage = %x, want %x", test.name, b, test.b)
+		}
+	}
+}
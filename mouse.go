@@ -0,0 +1,120 @@
+package btk
+
+import (
+	"github.com/pkg/errors"
+)
+
+// bootMouseDesc is the HID descriptor of a boot protocol mouse with 5
+// buttons and a wheel, the input report is buttons, X, Y and wheel
+var bootMouseDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xa1, 0x01, // Collection (Application)
+	0x09, 0x01, //   Usage (Pointer)
+	0xa1, 0x00, //   Collection (Physical)
+	0x05, 0x09, //     Usage Page (Button)
+	0x19, 0x01, //     Usage Minimum (1)
+	0x29, 0x05, //     Usage Maximum (5)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x95, 0x05, //     Report Count (5)
+	0x75, 0x01, //     Report Size (1)
+	0x81, 0x02, //     Input (Data, Variable, Absolute)
+	0x95, 0x01, //     Report Count (1)
+	0x75, 0x03, //     Report Size (3)
+	0x81, 0x01, //     Input (Constant)
+	0x05, 0x01, //     Usage Page (Generic Desktop)
+	0x09, 0x30, //     Usage (X)
+	0x09, 0x31, //     Usage (Y)
+	0x09, 0x38, //     Usage (Wheel)
+	0x15, 0x81, //     Logical Minimum (-127)
+	0x25, 0x7f, //     Logical Maximum (127)
+	0x75, 0x08, //     Report Size (8)
+	0x95, 0x03, //     Report Count (3)
+	0x81, 0x06, //     Input (Data, Variable, Relative)
+	0xc0, //   End Collection
+	0xc0, // End Collection
+}
+
+const (
+	usageX     = pageGenericDesktop<<16 | 0x30
+	usageY     = pageGenericDesktop<<16 | 0x31
+	usageWheel = pageGenericDesktop<<16 | 0x38
+)
+
+var bootMouse = mustParseDesc(bootMouseDesc)
+
+func mustParseDesc(desc []byte) *reportDesc {
+	d, err := parseDesc(desc)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// MouseSource is an InputSource translating reports of any mouse into boot
+// mouse reports
+type MouseSource struct {
+	src  InputSource
+	desc *reportDesc
+}
+
+// NewMouseSource returns a MouseSource on the given source, its descriptor
+// must describe a mouse
+func NewMouseSource(src InputSource) (*MouseSource, error) {
+	desc, err := parseDesc(src.Desc())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse HID descriptor")
+	}
+
+	if !isPointer(desc) {
+		return nil, errors.New("input source is not a mouse")
+	}
+
+	return &MouseSource{src: src, desc: desc}, nil
+}
+
+func isPointer(desc *reportDesc) bool {
+	for _, f := range desc.fields {
+		if f.typ == reportInput && f.hasUsage(usageX) {
+			return true
+		}
+	}
+	return false
+}
+
+// Desc returns the descriptor of a boot mouse
+func (s *MouseSource) Desc() []byte {
+	return bootMouseDesc
+}
+
+// ReadReport returns the next report of the mouse as a boot mouse report
+func (s *MouseSource) ReadReport() ([]byte, error) {
+	for {
+		report, err := s.src.ReadReport()
+		if err != nil {
+			return nil, err
+		}
+
+		var values []usageValue
+		for _, v := range s.desc.values(reportInput, report) {
+			switch {
+			case v.usage.page() == pageButton,
+				v.usage == usageX, v.usage == usageY, v.usage == usageWheel:
+				values = append(values, v)
+			}
+		}
+
+		// reports of other collections, e.g. media keys of a gaming mouse
+		if len(values) == 0 {
+			continue
+		}
+
+		return bootMouse.encode(reportInput, 0, values), nil
+	}
+}
+
+// Close closes the mouse
+func (s *MouseSource) Close() error {
+	return s.src.Close()
+}
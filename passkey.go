@@ -0,0 +1,89 @@
+package btk
+
+import (
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// passkeyDigits is the number of digits of a pairing passkey, with
+	// leading zeros
+	passkeyDigits = 6
+
+	usageKey1        = 0x1e
+	usageKey0        = 0x27
+	usageEnter       = 0x28
+	usageEscape      = 0x29
+	usageBackspace   = 0x2a
+	usageKeypadEnter = 0x58
+	usageKeypad1     = 0x59
+	usageKeypad0     = 0x62
+)
+
+// digitOf returns the digit of the number key or keypad key
+func digitOf(usage uint8) (uint32, bool) {
+	switch {
+	case usage == usageKey0 || usage == usageKeypad0:
+		return 0, true
+	case usage >= usageKey1 && usage < usageKey0:
+		return uint32(usage-usageKey1) + 1, true
+	case usage >= usageKeypad1 && usage < usageKeypad0:
+		return uint32(usage-usageKeypad1) + 1, true
+	}
+	return 0, false
+}
+
+// ReadPasskey reads a pairing passkey typed on the keyboard, i.e. the 6
+// digits shown on the host followed by Enter. Backspace deletes the last
+// digit and Escape gives up. The input doesn't go to the client until the
+// passkey is entered. ErrPairingCanceled is returned if it's given up, or
+// canceled by CancelInput.
+func (kb *Keyboard) ReadPasskey() (uint32, error) {
+	g, err := kb.grabKeys()
+	if err != nil {
+		return 0, err
+	}
+	defer kb.ungrab(g)
+
+	logrus.Warnln("Type the passkey shown on the host and press Enter")
+
+	var digits []uint32
+	for {
+		var p keyPress
+		select {
+		case p = <-g.presses:
+		case <-g.cancel:
+			return 0, ErrPairingCanceled
+		case <-kb.done:
+			return 0, ErrPairingCanceled
+		}
+
+		if d, ok := digitOf(p.usage); ok {
+			if len(digits) < passkeyDigits {
+				digits = append(digits, d)
+			}
+			logrus.WithField("digits", len(digits)).Debugln("Passkey digit entered")
+			continue
+		}
+
+		switch p.usage {
+		case usageBackspace:
+			if len(digits) > 0 {
+				digits = digits[:len(digits)-1]
+			}
+		case usageEscape:
+			return 0, ErrPairingCanceled
+		case usageEnter, usageKeypadEnter:
+			if len(digits) < passkeyDigits {
+				logrus.WithField("digits", len(digits)).
+					Warnf("Passkey has %d digits, type all of them", passkeyDigits)
+				continue
+			}
+
+			passkey := uint32(0)
+			for _, d := range digits {
+				passkey = passkey*10 + d
+			}
+			return passkey, nil
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package btk
+
+import (
+	"testing"
+	"time"
+)
+
+type passkeyResult struct {
+	passkey uint32
+	err     error
+}
+
+// readPasskey starts reading a passkey, and waits until the keyboard input
+// is grabbed for it
+func (h *testHost) readPasskey() <-chan passkeyResult {
+	h.t.Helper()
+
+	result := make(chan passkeyResult, 1)
+	go func() {
+		passkey, err := h.kb.ReadPasskey()
+		result <- passkeyResult{passkey, err}
+	}()
+
+	waitGrab(h.t, h.kb)
+	return result
+}
+
+// waitGrab waits until the keyboard input is grabbed
+func waitGrab(t *testing.T, kb *Keyboard) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		kb.Lock()
+		grabbed := kb.grab != nil
+		kb.Unlock()
+		if grabbed {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("keyboard input not grabbed")
+}
+
+// typeKeys presses and releases each key
+func (h *testHost) typeKeys(keys ...uint8) {
+	h.t.Helper()
+
+	for _, k := range keys {
+		h.send(bootKeys(k))
+		h.send(bootKeys())
+	}
+}
+
+func expectPasskey(t *testing.T, result <-chan passkeyResult, want passkeyResult) {
+	t.Helper()
+
+	select {
+	case r := <-result:
+		if r != want {
+			t.Errorf("passkey %06d, %v, want %06d, %v", r.passkey, r.err, want.passkey, want.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("passkey not read")
+	}
+}
+
+func TestReadPasskey(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []uint8
+		// last is the key which ends the input, it's held until the
+		// passkey is read
+		last uint8
+		want passkeyResult
+	}{
+		{"digits", []uint8{0x1e, 0x1f, 0x20, 0x21, 0x22, 0x23}, usageEnter, passkeyResult{123456, nil}},
+		{"leading zeros", []uint8{0x27, 0x27, 0x27, 0x27, 0x21, 0x1f}, usageEnter, passkeyResult{42, nil}},
+		{"keypad", []uint8{0x62, 0x59, 0x5a, 0x5b, 0x60, 0x61}, usageKeypadEnter, passkeyResult{12389, nil}},
+		{"extra digits", []uint8{0x1e, 0x1f, 0x20, 0x21, 0x22, 0x23, 0x24}, usageEnter, passkeyResult{123456, nil}},
+		{"backspace", []uint8{0x1e, 0x1f, 0x20, 0x21, 0x22, 0x23, usageBackspace, 0x25}, usageEnter, passkeyResult{123458, nil}},
+		{"backspace empty", []uint8{usageBackspace, 0x1e, 0x1f, 0x20, 0x21, 0x22, 0x23}, usageEnter, passkeyResult{123456, nil}},
+		{"early enter", []uint8{0x1e, 0x1f, 0x20, usageEnter, 0x21, 0x22, 0x23}, usageEnter, passkeyResult{123456, nil}},
+		{"other keys", []uint8{0x1e, 0x04, 0x1f, 0x20, 0x2c, 0x21, 0x22, 0x23}, usageEnter, passkeyResult{123456, nil}},
+		{"escape", []uint8{0x1e, 0x1f}, usageEscape, passkeyResult{0, ErrPairingCanceled}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := connectHost(t)
+			defer h.close()
+
+			result := h.readPasskey()
+			h.typeKeys(test.keys...)
+			h.send(bootKeys(test.last))
+			expectPasskey(t, result, test.want)
+
+			// nothing typed reaches the client, which gets the input
+			// back once the passkey is read
+			h.send(bootKeys())
+			h.expectInput(bootKeys())
+			h.send(bootKeys(0x04))
+			h.expectInput(bootKeys(0x04))
+		})
+	}
+}
+
+func TestReadPasskeyHeldKeys(t *testing.T) {
+	h := connectHost(t)
+	defer h.close()
+
+	h.send(bootKeys(0x1e))
+	h.expectInput(bootKeys(0x1e))
+
+	// the client sees the key released when the input is grabbed
+	result := h.readPasskey()
+	h.expectInput(bootKeys())
+
+	// and a key held since then isn't pressed again
+	h.send(bootKeys(0x1e, 0x1f))
+	h.send(bootKeys())
+	h.typeKeys(0x20, 0x21, 0x22, 0x23, 0x24)
+	h.send(bootKeys(usageEnter))
+	expectPasskey(t, result, passkeyResult{234567, nil})
+}
+
+func TestReadPasskeyCanceled(t *testing.T) {
+	h := connectHost(t)
+	defer h.close()
+
+	result := h.readPasskey()
+
+	// only one can take the input at a time
+	if _, err := h.kb.ReadPasskey(); err != errInputGrabbed {
+		t.Errorf("second ReadPasskey returned %v, want %v", err, errInputGrabbed)
+	}
+
+	h.kb.CancelInput()
+	expectPasskey(t, result, passkeyResult{0, ErrPairingCanceled})
+
+	h.send(bootKeys(0x04))
+	h.expectInput(bootKeys(0x04))
+}
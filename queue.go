@@ -0,0 +1,216 @@
+package btk
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/inoc603/btk/l2cap"
+	"github.com/pkg/errors"
+)
+
+// clientQueueSize is how many input reports can be queued for a client
+// before older ones are dropped
+const clientQueueSize = 64
+
+var errQueueClosed = errors.New("report queue closed")
+
+// DeliveryStats counts input reports sent to a client
+type DeliveryStats struct {
+	// Sent is the number of reports written to the client
+	Sent uint64
+	// Dropped is the number of reports dropped because the queue is full
+	// or the write failed
+	Dropped uint64
+	// Retried is the number of writes retried because the socket buffer
+	// is full
+	Retried uint64
+}
+
+type queuedReport struct {
+	id   uint8
+	data []byte
+}
+
+// reportQueue is a bounded queue of input reports to a client, delivered in
+// order by its own goroutine. When the client can't keep up and the queue is
+// full, the oldest report which is followed by a newer report of the same ID
+// is dropped, so the last report of each ID, i.e. the final key state, is
+// always delivered.
+type reportQueue struct {
+	conn *l2cap.Conn
+	size int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	reports []queuedReport
+	closed  bool
+	stats   DeliveryStats
+	done    chan struct{}
+}
+
+func newReportQueue(conn *l2cap.Conn, size int) *reportQueue {
+	q := &reportQueue{
+		conn: conn,
+		size: size,
+		done: make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	go q.run()
+	return q
+}
+
+// push queues a message of the report ID
+func (q *reportQueue) push(id uint8, data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.reports = append(q.reports, queuedReport{id, data})
+	if len(q.reports) > q.size {
+		q.dropSuperseded()
+	}
+	q.cond.Signal()
+}
+
+// dropSuperseded drops the oldest report which has a newer report of the same
+// ID in the queue. If every report is the last of its ID the queue is left
+// over its size, which is still bounded by the number of report IDs.
+func (q *reportQueue) dropSuperseded() {
+	last := make(map[uint8]int)
+	for i, r := range q.reports {
+		last[r.id] = i
+	}
+
+	for i, r := range q.reports {
+		if last[r.id] != i {
+			q.reports = append(q.reports[:i], q.reports[i+1:]...)
+			q.stats.Dropped++
+			return
+		}
+	}
+}
+
+func (q *reportQueue) run() {
+	for {
+		q.mu.Lock()
+		for len(q.reports) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		r := q.reports[0]
+		q.reports = q.reports[1:]
+		q.mu.Unlock()
+
+		err := q.write(r.data)
+
+		q.mu.Lock()
+		if err != nil {
+			q.stats.Dropped++
+		} else {
+			q.stats.Sent++
+		}
+		q.mu.Unlock()
+
+		if err != nil && !q.isClosed() {
+			logrus.WithError(err).Errorln("Error in write to client")
+		}
+	}
+}
+
+// write writes the message to the client, waiting for the socket to be
+// writable if its buffer is full
+func (q *reportQueue) write(data []byte) error {
+	for {
+		err := tryWrite(q.conn, data)
+		if err != syscall.EAGAIN {
+			return err
+		}
+
+		q.mu.Lock()
+		q.stats.Retried++
+		q.mu.Unlock()
+
+		// closing the socket wakes the wait up
+		if err := waitWrite(q.conn); err != nil {
+			return err
+		}
+
+		if q.isClosed() {
+			return errQueueClosed
+		}
+	}
+}
+
+func (q *reportQueue) isClosed() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stats returns the delivery counters of the queue
+func (q *reportQueue) Stats() DeliveryStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
+
+// close stops delivery, queued reports are discarded
+func (q *reportQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.reports = nil
+	close(q.done)
+	q.cond.Broadcast()
+}
+
+// tryWrite writes a packet to the connection without blocking, it returns
+// EAGAIN if the send buffer is full
+func tryWrite(conn *l2cap.Conn, data []byte) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	if rerr := rc.Write(func(fd uintptr) bool {
+		_, err = syscall.Write(int(fd), data)
+		return true
+	}); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// waitWrite blocks until the connection is writable or closed
+func waitWrite(conn *l2cap.Conn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	polled := false
+	return rc.Write(func(uintptr) bool {
+		// returning false the first time waits for the socket to be
+		// writable, then the callback is called again
+		if polled {
+			return true
+		}
+		polled = true
+		return false
+	})
+}
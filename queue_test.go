@@ -0,0 +1,106 @@
+package btk
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReportQueueDropSuperseded(t *testing.T) {
+	tests := []struct {
+		ids  []uint8
+		want []uint8
+	}{
+		// the oldest superseded report is dropped first
+		{[]uint8{1, 1, 1}, []uint8{1, 1}},
+		{[]uint8{1, 2, 1}, []uint8{2, 1}},
+		{[]uint8{2, 1, 1}, []uint8{2, 1}},
+		// the last report of every ID is kept
+		{[]uint8{1, 2, 3}, []uint8{1, 2, 3}},
+	}
+
+	for _, test := range tests {
+		q := &reportQueue{}
+		for _, id := range test.ids {
+			q.reports = append(q.reports, queuedReport{id: id})
+		}
+		q.dropSuperseded()
+
+		var ids []uint8
+		for _, r := range q.reports {
+			ids = append(ids, r.id)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%v left %v, want %v", test.ids, ids, test.want)
+		}
+	}
+}
+
+func TestReportQueueStalledClient(t *testing.T) {
+	kb, host := channelPair(t)
+	defer kb.Close()
+	defer host.Close()
+
+	// a tiny socket buffer, so the host stalls the queue quickly
+	rc, err := kb.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := newReportQueue(kb, 8)
+	defer q.close()
+
+	// the host doesn't read until the writes are stalled
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		q.push(1, []byte{0xa1, 1, uint8(i)})
+		if i == keys/2 {
+			q.push(2, []byte{0xa1, 2, 0xe9})
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Stats().Retried == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("writes to the host never stalled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.push(1, []byte{0xa1, 1, keys})
+
+	// reports arrive in order, and the last one of each ID always arrives
+	h := &testHost{t: t}
+	next, media := 0, false
+	for next <= keys {
+		switch p := h.read(host); p[1] {
+		case 1:
+			if int(p[2]) < next {
+				t.Fatalf("report %d arrived after %d", p[2], next-1)
+			}
+			next = int(p[2]) + 1
+		case 2:
+			media = true
+		}
+	}
+	if !media {
+		t.Error("the media report is dropped")
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for s := q.Stats(); s.Sent+s.Dropped != keys+2; s = q.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v don't add up to %d reports", s, keys+2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := q.Stats(); s.Dropped == 0 {
+		t.Errorf("stats %+v, want dropped reports", s)
+	}
+}
@@ -0,0 +1,226 @@
+package btk
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+var errSourceAbsent = errors.New("input source not plugged")
+
+// ReopeningSource is an InputSource which survives its device being
+// unplugged, e.g. one half of a split keyboard or a mouse next to the
+// keyboard. When the source is gone, all its keys and buttons are released,
+// and it's opened again in place once the device is plugged. Output reports
+// are sent again to the reopened source.
+type ReopeningSource struct {
+	desc   []byte
+	report *reportDesc
+	open   func() (InputSource, error)
+
+	done chan struct{}
+	once sync.Once
+
+	mu  sync.Mutex
+	src InputSource
+	// pending reports to be returned before reading from the source
+	pending [][]byte
+	// output is the last output report of each report ID
+	output map[uint8][]byte
+}
+
+// NewReopeningSource returns a ReopeningSource on the source, which is
+// opened by open again when it's gone. src may be nil if the device isn't
+// plugged yet, it's opened later. Sources returned by open must have the
+// descriptor desc, as the host only knows that one.
+func NewReopeningSource(desc []byte, src InputSource, open func() (InputSource, error)) (*ReopeningSource, error) {
+	report, err := parseDesc(desc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse HID descriptor")
+	}
+
+	return &ReopeningSource{
+		desc:   desc,
+		report: report,
+		open:   open,
+		done:   make(chan struct{}),
+		src:    src,
+		output: make(map[uint8][]byte),
+	}, nil
+}
+
+// Desc returns the descriptor of the source
+func (s *ReopeningSource) Desc() []byte {
+	return s.desc
+}
+
+func (s *ReopeningSource) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *ReopeningSource) source() InputSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src
+}
+
+// ReadReport returns the next report of the source. While the source is
+// gone, it blocks until the source is reopened, and only returns an error
+// when it's closed, or the reopened source has another descriptor.
+func (s *ReopeningSource) ReadReport() ([]byte, error) {
+	for {
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			r := s.pending[0]
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+			return r, nil
+		}
+		src := s.src
+		s.mu.Unlock()
+
+		if src == nil {
+			var err error
+			if src, err = s.reopen(); err != nil {
+				return nil, err
+			}
+		}
+
+		report, err := src.ReadReport()
+		if err == nil {
+			return report, nil
+		}
+
+		if s.closed() {
+			return nil, ErrSourceClosed
+		}
+
+		logrus.WithError(err).Warnln("Input source unplugged")
+		src.Close()
+
+		s.mu.Lock()
+		s.src = nil
+		s.pending = append(s.pending, s.emptyReports()...)
+		s.mu.Unlock()
+	}
+}
+
+// emptyReports returns an all zero input report of each report ID, which
+// release all keys and buttons
+func (s *ReopeningSource) emptyReports() [][]byte {
+	var reports [][]byte
+	for _, id := range s.report.reportIDsOf(reportInput) {
+		reports = append(reports, s.report.encode(reportInput, id, nil))
+	}
+	return reports
+}
+
+// reopen opens the source until it succeeds or the source is closed
+func (s *ReopeningSource) reopen() (InputSource, error) {
+	uevents, err := newUeventConn()
+	if err != nil {
+		logrus.WithError(err).Warnln("Failed to watch uevents, polling for the input source")
+	} else {
+		defer uevents.Close()
+	}
+
+	for {
+		if s.closed() {
+			return nil, ErrSourceClosed
+		}
+
+		if src, err := s.open(); err == nil {
+			if !bytes.Equal(src.Desc(), s.desc) {
+				src.Close()
+				return nil, errors.New("HID descriptor of the reopened source changed")
+			}
+
+			s.mu.Lock()
+			// the source may be closed while it's being opened
+			if s.closed() {
+				s.mu.Unlock()
+				src.Close()
+				return nil, ErrSourceClosed
+			}
+			s.src = src
+			var output [][]byte
+			for _, r := range s.output {
+				output = append(output, r)
+			}
+			s.mu.Unlock()
+
+			logrus.Infoln("Input source plugged")
+			for _, r := range output {
+				if err := writeOutput(src, r); err != nil {
+					logrus.WithError(err).Warnln("Failed to apply output report")
+				}
+			}
+			return src, nil
+		}
+
+		waitPlug(uevents)
+	}
+}
+
+// WriteReport sends an output report to the source, it's sent again when the
+// source is reopened
+func (s *ReopeningSource) WriteReport(report []byte) error {
+	if len(report) == 0 {
+		return nil
+	}
+
+	id := uint8(0)
+	if s.report.ids {
+		id = report[0]
+	}
+
+	s.mu.Lock()
+	s.output[id] = report
+	src := s.src
+	s.mu.Unlock()
+
+	if src == nil {
+		return nil
+	}
+	return writeOutput(src, report)
+}
+
+// SetFeature sends a feature report to the source
+func (s *ReopeningSource) SetFeature(report []byte) error {
+	src := s.source()
+	if src == nil {
+		return errSourceAbsent
+	}
+	return setFeature(src, report)
+}
+
+// GetFeature reads the feature report with the given ID from the source
+func (s *ReopeningSource) GetFeature(id uint8) ([]byte, error) {
+	src := s.source()
+	if src == nil {
+		return nil, errSourceAbsent
+	}
+	return getFeature(src, id)
+}
+
+// Close closes the source, a blocked ReadReport returns
+func (s *ReopeningSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.src != nil {
+		return s.src.Close()
+	}
+	return nil
+}
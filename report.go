@@ -0,0 +1,212 @@
+package btk
+
+// bootKeyboardDesc is the HID descriptor of a boot protocol keyboard, taken
+// from the HID spec appendix B.1, with 8 byte input reports of modifiers and
+// six keys, and 1 byte output reports of LEDs
+var bootKeyboardDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xa1, 0x01, // Collection (Application)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0xe0, //   Usage Minimum (Left Control)
+	0x29, 0xe7, //   Usage Maximum (Right GUI)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Variable, Absolute)
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x08, //   Report Size (8)
+	0x81, 0x01, //   Input (Constant)
+	0x95, 0x05, //   Report Count (5)
+	0x75, 0x01, //   Report Size (1)
+	0x05, 0x08, //   Usage Page (LEDs)
+	0x19, 0x01, //   Usage Minimum (Num Lock)
+	0x29, 0x05, //   Usage Maximum (Kana)
+	0x91, 0x02, //   Output (Data, Variable, Absolute)
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x03, //   Report Size (3)
+	0x91, 0x01, //   Output (Constant)
+	0x95, 0x06, //   Report Count (6)
+	0x75, 0x08, //   Report Size (8)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x65, //   Logical Maximum (101)
+	0x05, 0x07, //   Usage Page (Keyboard)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, 0x65, //   Usage Maximum (101)
+	0x81, 0x00, //   Input (Data, Array)
+	0xc0, // End Collection
+}
+
+const (
+	// usageErrorRollOver is reported in all key slots when more keys are
+	// pressed than a boot report can hold
+	usageErrorRollOver  = 0x01
+	usageErrorUndefined = 0x03
+
+	usageLeftControl = 0xe0
+	usageRightGUI    = 0xe7
+
+	bootKeyboardKeys = 6
+)
+
+// keyState tracks the pressed keys of a keyboard by their usage ID on the
+// HID keyboard page
+type keyState struct {
+	mods uint8
+	// keys are non-modifier keys in the order they are pressed
+	keys []uint8
+}
+
+func isModifier(usage uint8) bool {
+	return usage >= usageLeftControl && usage <= usageRightGUI
+}
+
+func (s *keyState) press(usage uint8) {
+	if isModifier(usage) {
+		s.mods |= 1 << (usage - usageLeftControl)
+		return
+	}
+
+	for _, k := range s.keys {
+		if k == usage {
+			return
+		}
+	}
+	s.keys = append(s.keys, usage)
+}
+
+func (s *keyState) release(usage uint8) {
+	if isModifier(usage) {
+		s.mods &^= 1 << (usage - usageLeftControl)
+		return
+	}
+
+	for i, k := range s.keys {
+		if k == usage {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *keyState) reset() {
+	s.mods = 0
+	s.keys = s.keys[:0]
+}
+
+// bootReport returns the state as an 8 byte boot keyboard input report
+func (s *keyState) bootReport() []byte {
+	r := make([]byte, 2+bootKeyboardKeys)
+	r[0] = s.mods
+
+	if len(s.keys) > bootKeyboardKeys {
+		for i := 2; i < len(r); i++ {
+			r[i] = usageErrorRollOver
+		}
+		return r
+	}
+
+	copy(r[2:], s.keys)
+	return r
+}
+
+// set presses exactly the held keys, keeping the order of keys which are
+// still pressed. It returns true if the state is changed.
+func (s *keyState) set(held map[uint8]bool) bool {
+	changed := false
+	for i := 0; i < 8; i++ {
+		k := uint8(usageLeftControl + i)
+		if on := s.mods&(1<<uint(i)) != 0; on != held[k] {
+			changed = true
+		}
+		if held[k] {
+			s.press(k)
+		} else {
+			s.release(k)
+		}
+	}
+
+	for _, k := range append([]uint8(nil), s.keys...) {
+		if !held[k] {
+			s.release(k)
+			changed = true
+		}
+	}
+
+	// keys pressed since last report, the order among them is lost
+	for k := range held {
+		if isModifier(k) || s.has(k) {
+			continue
+		}
+		s.press(k)
+		changed = true
+	}
+
+	return changed
+}
+
+func (s *keyState) has(usage uint8) bool {
+	for _, k := range s.keys {
+		if k == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// pressedKeys returns the usages of the pressed keys in a keyboard report,
+// it returns false if the keyboard reports a rollover error, in which case
+// the report should be ignored
+func pressedKeys(desc *reportDesc, report []byte) ([]uint8, bool) {
+	var keys []uint8
+
+	for _, v := range desc.values(reportInput, report) {
+		if v.usage.page() != pageKeyboard || v.value == 0 || v.usage.id() > 0xff {
+			continue
+		}
+
+		switch id := uint8(v.usage.id()); {
+		case id == usageErrorRollOver:
+			return nil, false
+		case id > usageErrorUndefined:
+			keys = append(keys, id)
+		}
+	}
+
+	return keys, true
+}
+
+// heldKeys is the pressed keys of each report ID of a keyboard
+type heldKeys map[uint8][]uint8
+
+// update decodes the pressed keys of a keyboard report, it returns false if
+// the report should be ignored, see pressedKeys
+func (h heldKeys) update(desc *reportDesc, report []byte) bool {
+	id, _ := desc.reportPayload(report)
+	keys, ok := pressedKeys(desc, report)
+	if !ok {
+		return false
+	}
+	h[id] = keys
+	return true
+}
+
+// union adds the keys pressed in any report ID to held, and returns it
+func (h heldKeys) union(held map[uint8]bool) map[uint8]bool {
+	for _, keys := range h {
+		for _, k := range keys {
+			held[k] = true
+		}
+	}
+	return held
+}
+
+// ledValues decodes the LED byte of a boot keyboard output report
+func ledValues(leds uint8) []usageValue {
+	var values []usageValue
+	for i := uint16(0); i < 8; i++ {
+		values = append(values, usageValue{makeUsage(pageLED, i+1), int32(leds>>i) & 1})
+	}
+	return values
+}
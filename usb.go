@@ -0,0 +1,514 @@
+package btk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/zserge/hid"
+)
+
+const sysUsbDevices = "/sys/bus/usb/devices"
+
+const (
+	// usbReqTypeClassOut is a host to device class request to an interface
+	usbReqTypeClassOut = 0x21
+	// usbReqSetReport is the HID SET_REPORT request, its value is the
+	// report type and report ID
+	usbReqSetReport = 0x09
+
+	usbControlTimeout = time.Second
+)
+
+// UsbDevice is a HID interface of a usb device
+type UsbDevice struct {
+	hid.Info
+	// Path is the usbfs device file, e.g. /dev/bus/usb/001/004
+	Path string
+	// BusPath is the physical location of the device, i.e. its name in
+	// /sys/bus/usb/devices, e.g. 1-1.2 is port 2 of the hub on port 1 of
+	// bus 1. It stays the same as long as the device is plugged into the
+	// same port.
+	BusPath string
+	// Serial is the serial number string of the device, it's empty if the
+	// device doesn't have one
+	Serial string
+
+	dev hid.Device
+}
+
+// DeviceMatcher tells if a usb HID interface should be used
+type DeviceMatcher func(UsbDevice) bool
+
+// MatchKeyboard matches interfaces of the boot keyboard protocol
+func MatchKeyboard(d UsbDevice) bool {
+	return d.Protocol == protocolKeyboard
+}
+
+// MatchMouse matches interfaces of the boot mouse protocol
+func MatchMouse(d UsbDevice) bool {
+	return d.Protocol == protocolMouse
+}
+
+// MatchID matches devices of the given vendor and product ID
+func MatchID(vendor, product uint16) DeviceMatcher {
+	return func(d UsbDevice) bool {
+		return d.Vendor == vendor && d.Product == product
+	}
+}
+
+// MatchSerial matches devices of the given serial number
+func MatchSerial(serial string) DeviceMatcher {
+	return func(d UsbDevice) bool {
+		return d.Serial == serial
+	}
+}
+
+// MatchBusPath matches devices on the given port, see UsbDevice.BusPath
+func MatchBusPath(path string) DeviceMatcher {
+	return func(d UsbDevice) bool {
+		return d.BusPath == path
+	}
+}
+
+// MatchInterface matches the interface of the given number
+func MatchInterface(n uint8) DeviceMatcher {
+	return func(d UsbDevice) bool {
+		return d.Interface == n
+	}
+}
+
+// ListUsbDevices returns all usb HID interfaces
+func ListUsbDevices() []UsbDevice {
+	var devices []UsbDevice
+
+	sysfs := map[string]sysUsbDevice{}
+	walkUsbfs(func(d *usbfsDevice) {
+		sys, ok := sysfs[d.path]
+		if !ok {
+			sys = findSysUsbDevice(d.path)
+			sysfs[d.path] = sys
+		}
+
+		devices = append(devices, UsbDevice{
+			Info:    d.info,
+			Path:    d.path,
+			BusPath: sys.name,
+			Serial:  sys.serial,
+			dev:     d,
+		})
+	})
+
+	return devices
+}
+
+// FindUsbDevices returns the usb HID interfaces matching all matchers
+func FindUsbDevices(matchers ...DeviceMatcher) []UsbDevice {
+	var found []UsbDevice
+
+Devices:
+	for _, d := range ListUsbDevices() {
+		for _, match := range matchers {
+			if !match(d) {
+				continue Devices
+			}
+		}
+		found = append(found, d)
+	}
+
+	return found
+}
+
+// FindUsbDevice returns the first usb HID interface matching all matchers
+func FindUsbDevice(matchers ...DeviceMatcher) (UsbDevice, bool) {
+	if found := FindUsbDevices(matchers...); len(found) > 0 {
+		return found[0], true
+	}
+	return UsbDevice{}, false
+}
+
+type sysUsbDevice struct {
+	name   string
+	serial string
+}
+
+// findSysUsbDevice finds the device in sysfs by the bus and device number in
+// its usbfs path, i.e. /dev/bus/usb/BBB/DDD
+func findSysUsbDevice(path string) sysUsbDevice {
+	busnum, err1 := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+	devnum, err2 := strconv.Atoi(filepath.Base(path))
+	if err1 != nil || err2 != nil {
+		return sysUsbDevice{}
+	}
+
+	dirs, _ := ioutil.ReadDir(sysUsbDevices)
+	for _, dir := range dirs {
+		// interfaces are named like 1-1.2:1.0
+		if strings.Contains(dir.Name(), ":") {
+			continue
+		}
+
+		base := filepath.Join(sysUsbDevices, dir.Name())
+		if readSysInt(base, "busnum") != busnum || readSysInt(base, "devnum") != devnum {
+			continue
+		}
+
+		return sysUsbDevice{
+			name:   dir.Name(),
+			serial: readSysString(base, "serial"),
+		}
+	}
+
+	return sysUsbDevice{}
+}
+
+func readSysString(dir, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func readSysInt(dir, name string) int {
+	n, err := strconv.Atoi(readSysString(dir, name))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// UsbSource is an InputSource on a usb HID device, the device is claimed
+// through usbfs, so it's detached from the kernel driver while in use.
+type UsbSource struct {
+	dev  hid.Device
+	desc []byte
+
+	done chan struct{}
+	once sync.Once
+}
+
+// OpenUsbKeyboard opens the first usb HID interface matching all the given
+// matchers, or the first usb keyboard if there's no matcher. If the device
+// has media keys on other interfaces, they're opened as well and combined
+// with the keyboard.
+func OpenUsbKeyboard(matchers ...DeviceMatcher) (InputSource, error) {
+	if len(matchers) == 0 {
+		matchers = []DeviceMatcher{MatchKeyboard}
+	}
+
+	dev, ok := FindUsbDevice(matchers...)
+	if !ok {
+		return nil, errors.New("no hid keyboard found")
+	}
+
+	src, err := OpenUsbDevice(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	return withUsbMedia(src, dev), nil
+}
+
+// withUsbMedia combines the keyboard with media keys on other interfaces of
+// the given devices, the keyboard is returned as it is if there's none
+func withUsbMedia(kb InputSource, devs ...UsbDevice) InputSource {
+	var sources []InputSource
+	opened := map[UsbDevice]bool{}
+
+	for _, dev := range devs {
+		for _, d := range FindUsbDevices(func(d UsbDevice) bool {
+			return d.Path == dev.Path && d.Interface != dev.Interface &&
+				d.Protocol != protocolKeyboard && d.Protocol != protocolMouse
+		}) {
+			key := UsbDevice{Info: d.Info, Path: d.Path}
+			if opened[key] {
+				continue
+			}
+			opened[key] = true
+
+			// only the interface with media keys is taken from the kernel
+			// driver, the others keep working on this machine
+			if !sysHasMediaKeys(d) {
+				continue
+			}
+
+			src, err := OpenUsbDevice(d)
+			if err != nil {
+				logrus.WithError(err).WithField("interface", d.Interface).
+					Warnln("Failed to open interface for media keys")
+				continue
+			}
+
+			// media keys of one half of a merged keyboard come back with it
+			media, err := NewReopeningSource(src.Desc(), src, reopenUsbDevice(d))
+			if err != nil {
+				src.Close()
+				continue
+			}
+
+			sources = append(sources, media)
+		}
+	}
+
+	if len(sources) == 0 {
+		return kb
+	}
+
+	media, err := NewMediaSource(sources...)
+	if err != nil {
+		closeAll(sources)
+		return kb
+	}
+
+	src, err := NewCompositeSource(kb, media)
+	if err != nil {
+		logrus.WithError(err).Warnln("Failed to combine media keys")
+		media.Close()
+		return kb
+	}
+
+	logrus.Debugln("Media keys found")
+	return src
+}
+
+// sysHasMediaKeys tells if the interface has media keys by the report
+// descriptor in sysfs, which is there while the interface is bound to the
+// kernel HID driver, i.e. /sys/bus/usb/devices/1-1.2:1.1/0003:*/report_descriptor
+func sysHasMediaKeys(d UsbDevice) bool {
+	if d.BusPath == "" {
+		return false
+	}
+
+	pattern := filepath.Join(sysUsbDevices,
+		fmt.Sprintf("%s:*.%d", d.BusPath, d.Interface), "*", "report_descriptor")
+	files, _ := filepath.Glob(pattern)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if desc, err := parseDesc(b); err == nil && hasMediaKeys(desc) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OpenMergedUsbKeyboards opens all usb HID interfaces matching all the given
+// matchers, or all usb keyboards if there's no matcher, and merges them
+// into one keyboard. See MergedSource. Media keys of all the devices are
+// combined with the keyboard like OpenUsbKeyboard.
+func OpenMergedUsbKeyboards(matchers ...DeviceMatcher) (InputSource, error) {
+	if len(matchers) == 0 {
+		matchers = []DeviceMatcher{MatchKeyboard}
+	}
+
+	var sources []InputSource
+	var devs []UsbDevice
+	for _, dev := range FindUsbDevices(matchers...) {
+		src, err := OpenUsbDevice(dev)
+		if err != nil {
+			logrus.WithError(err).WithField("path", dev.Path).
+				Warnln("Failed to open keyboard")
+			continue
+		}
+
+		// each keyboard is replugged on its own, the others keep working
+		kb, err := NewReopeningSource(src.Desc(), src, reopenUsbDevice(dev))
+		if err != nil {
+			src.Close()
+			continue
+		}
+
+		sources = append(sources, kb)
+		devs = append(devs, dev)
+	}
+
+	if len(sources) == 0 {
+		return nil, errors.New("no hid keyboard found")
+	}
+
+	src, err := NewMergedSource(sources...)
+	if err != nil {
+		closeAll(sources)
+		return nil, err
+	}
+	return withUsbMedia(src, devs...), nil
+}
+
+// reopenUsbDevice returns a function opening the same interface of the usb
+// device again after it's replugged into the same port
+func reopenUsbDevice(dev UsbDevice) func() (InputSource, error) {
+	return func() (InputSource, error) {
+		d, ok := FindUsbDevice(
+			MatchID(dev.Vendor, dev.Product),
+			MatchBusPath(dev.BusPath),
+			MatchInterface(dev.Interface),
+		)
+		if !ok {
+			return nil, errors.New("usb device not plugged")
+		}
+
+		src, err := OpenUsbDevice(d)
+		if err != nil {
+			return nil, err
+		}
+		return src, nil
+	}
+}
+
+// OpenUsbMouse opens the first usb HID interface matching all the given
+// matchers, or the first usb mouse if there's no matcher, as a MouseSource
+func OpenUsbMouse(matchers ...DeviceMatcher) (InputSource, error) {
+	if len(matchers) == 0 {
+		matchers = []DeviceMatcher{MatchMouse}
+	}
+
+	dev, ok := FindUsbDevice(matchers...)
+	if !ok {
+		return nil, errors.New("no hid mouse found")
+	}
+
+	src, err := OpenUsbDevice(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	mouse, err := NewMouseSource(src)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return mouse, nil
+}
+
+// OpenOptionalUsbMouse is OpenUsbMouse for a mouse which may not be plugged.
+// The mouse is opened whenever it's plugged, and opened again after it's
+// unplugged, meanwhile the source just has no input.
+func OpenOptionalUsbMouse(matchers ...DeviceMatcher) (*ReopeningSource, error) {
+	open := func() (InputSource, error) {
+		return OpenUsbMouse(matchers...)
+	}
+
+	src, err := open()
+	if err != nil {
+		logrus.WithError(err).Infoln("Usb mouse not plugged yet")
+		src = nil
+	}
+
+	return NewReopeningSource(bootMouseDesc, src, open)
+}
+
+// OpenUsbDevice opens the usb HID interface
+func OpenUsbDevice(d UsbDevice) (*UsbSource, error) {
+	return NewUsbSource(d.dev)
+}
+
+// NewUsbSource opens the given usb HID device
+func NewUsbSource(dev hid.Device) (*UsbSource, error) {
+	if err := dev.Open(); err != nil {
+		return nil, errors.Wrap(err, "failed to open hid device")
+	}
+
+	desc, err := dev.HIDReport()
+	if err != nil {
+		dev.Close()
+		return nil, errors.Wrap(err, "failed to get HID descriptor")
+	}
+
+	return &UsbSource{
+		dev:  dev,
+		desc: desc,
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Desc returns the HID descriptor of the usb device
+func (s *UsbSource) Desc() []byte {
+	return s.desc
+}
+
+// Info returns the information of the usb device
+func (s *UsbSource) Info() hid.Info {
+	return s.dev.Info()
+}
+
+// ReadReport reads the next input report from the interrupt endpoint
+func (s *UsbSource) ReadReport() ([]byte, error) {
+	for {
+		// Set timeout to 1 second, so read does not block forever
+		report, err := s.dev.Read(-1, time.Second)
+
+		select {
+		case <-s.done:
+			return nil, ErrSourceClosed
+		default:
+		}
+
+		if err != nil {
+			// connection timeout is normal when the keyboard is idle
+			if err == syscall.ETIMEDOUT {
+				continue
+			}
+			return nil, err
+		}
+
+		return report, nil
+	}
+}
+
+// WriteReport sends an output report to the usb device, on the interrupt OUT
+// endpoint if there's one, otherwise by SET_REPORT on the control endpoint
+func (s *UsbSource) WriteReport(report []byte) error {
+	dev, ok := s.dev.(*usbfsDevice)
+	if !ok || dev.OutputEndpoint() > 0 {
+		_, err := s.dev.Write(report, usbControlTimeout)
+		return err
+	}
+
+	// Write doesn't know the report ID, it sends SET_REPORT with ID 0
+	_, err := dev.Control(
+		usbReqTypeClassOut, usbReqSetReport,
+		int(ReportOutput)<<8|int(s.reportID(report)),
+		int(s.dev.Info().Interface), report, usbControlTimeout,
+	)
+	return err
+}
+
+// reportID returns the report ID of a report of the usb device, which is 0 if
+// the descriptor has no report IDs
+func (s *UsbSource) reportID(report []byte) uint8 {
+	if len(report) == 0 || !hasReportIDs(s.desc) {
+		return 0
+	}
+	return report[0]
+}
+
+// SetFeature sends a feature report to the usb device
+func (s *UsbSource) SetFeature(report []byte) error {
+	return s.dev.SetReport(int(s.reportID(report)), report)
+}
+
+// GetFeature reads the feature report with the given ID from the usb device
+func (s *UsbSource) GetFeature(id uint8) ([]byte, error) {
+	return s.dev.GetReport(int(id))
+}
+
+// Close releases the usb device
+func (s *UsbSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		// Violently close the usb device, a pending read will fail
+		s.dev.Close()
+	})
+	return nil
+}
@@ -0,0 +1,332 @@
+package btk
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/zserge/hid"
+)
+
+const devBusUsb = "/dev/bus/usb"
+
+// usb descriptor types and the HID class, see the usb and HID specs
+const (
+	usbDescDevice    = 0x01
+	usbDescConfig    = 0x02
+	usbDescInterface = 0x04
+	usbDescEndpoint  = 0x05
+	usbDescReport    = 0x22
+
+	usbClassHID = 0x03
+
+	usbEndpointIn        = 0x80
+	usbEndpointInterrupt = 0x03
+)
+
+// usb control requests used besides SET_REPORT
+const (
+	usbReqTypeStandardIn = 0x81
+	usbReqTypeClassIn    = 0xa1
+	usbReqGetDescriptor  = 0x06
+	usbReqGetReport      = 0x01
+)
+
+// usbdevfsCtrlTransfer is struct usbdevfs_ctrltransfer in linux/usbdevice_fs.h
+type usbdevfsCtrlTransfer struct {
+	RequestType uint8
+	Request     uint8
+	Value       uint16
+	Index       uint16
+	Length      uint16
+	Timeout     uint32
+	Data        unsafe.Pointer
+}
+
+// usbdevfsBulkTransfer is struct usbdevfs_bulktransfer in linux/usbdevice_fs.h
+type usbdevfsBulkTransfer struct {
+	Endpoint uint32
+	Length   uint32
+	Timeout  uint32
+	Data     unsafe.Pointer
+}
+
+// usbdevfsIoctl is struct usbdevfs_ioctl in linux/usbdevice_fs.h
+type usbdevfsIoctl struct {
+	Interface int32
+	Code      int32
+	Data      unsafe.Pointer
+}
+
+// ioctl request numbers, see linux/usbdevice_fs.h
+var (
+	usbdevfsControl    = ioc(iocWrite|iocRead, 'U', 0, unsafe.Sizeof(usbdevfsCtrlTransfer{}))
+	usbdevfsBulk       = ioc(iocWrite|iocRead, 'U', 2, unsafe.Sizeof(usbdevfsBulkTransfer{}))
+	usbdevfsClaim      = ioc(iocRead, 'U', 15, 4)
+	usbdevfsRelease    = ioc(iocRead, 'U', 16, 4)
+	usbdevfsIoctlReq   = ioc(iocWrite|iocRead, 'U', 18, unsafe.Sizeof(usbdevfsIoctl{}))
+	usbdevfsDisconnect = ioc(0, 'U', 22, 0)
+	usbdevfsConnect    = ioc(0, 'U', 23, 0)
+)
+
+// usbfsDevice is a HID interface of a usb device, used through its usbfs
+// device file. It implements hid.Device.
+type usbfsDevice struct {
+	info hid.Info
+	// path is the usbfs device file, e.g. /dev/bus/usb/001/004
+	path string
+
+	// epIn and epOut are the interrupt endpoints of the interface, epOut is
+	// 0 if there's none
+	epIn   int
+	epOut  int
+	inSize int
+
+	f *os.File
+}
+
+// walkUsbfs calls fn with each HID interface of the usb devices in usbfs
+func walkUsbfs(fn func(*usbfsDevice)) {
+	filepath.Walk(devBusUsb, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+
+		desc, err := ioutil.ReadFile(path)
+		if err != nil {
+			logrus.WithError(err).WithField("path", path).Debugln("Failed to read usb descriptors")
+			return nil
+		}
+
+		for _, d := range parseUsbfsDesc(path, desc) {
+			fn(d)
+		}
+		return nil
+	})
+}
+
+// parseUsbfsDesc finds the HID interfaces in the descriptors read from a usbfs
+// device file, which are the device descriptor followed by the configuration
+// descriptors
+func parseUsbfsDesc(path string, desc []byte) []*usbfsDevice {
+	var devices []*usbfsDevice
+	var info hid.Info
+	var dev *usbfsDevice
+
+	for len(desc) >= 2 {
+		n := int(desc[0])
+		if n < 2 || n > len(desc) {
+			break
+		}
+		d := desc[:n]
+		desc = desc[n:]
+
+		switch d[1] {
+		case usbDescDevice:
+			if n < 14 {
+				return nil
+			}
+			info.Vendor = binary.LittleEndian.Uint16(d[8:])
+			info.Product = binary.LittleEndian.Uint16(d[10:])
+			info.Revision = binary.LittleEndian.Uint16(d[12:])
+		case usbDescConfig:
+			dev = nil
+		case usbDescInterface:
+			dev = nil
+			// alternate settings of HID interfaces are ignored
+			if n < 9 || d[5] != usbClassHID || d[3] != 0 {
+				continue
+			}
+
+			info.Interface = d[2]
+			info.SubClass = d[6]
+			info.Protocol = d[7]
+			dev = &usbfsDevice{info: info, path: path}
+			devices = append(devices, dev)
+		case usbDescEndpoint:
+			if dev == nil || n < 7 || d[3]&0x03 != usbEndpointInterrupt {
+				continue
+			}
+
+			addr := int(d[2])
+			if addr&usbEndpointIn != 0 {
+				if dev.epIn == 0 {
+					dev.epIn = addr
+					dev.inSize = int(binary.LittleEndian.Uint16(d[4:]))
+				}
+			} else if dev.epOut == 0 {
+				dev.epOut = addr
+			}
+		}
+	}
+
+	return devices
+}
+
+// Open opens the device file and claims the interface from the kernel driver
+func (d *usbfsDevice) Open() error {
+	if d.f != nil {
+		return errors.New("usb device already opened")
+	}
+
+	f, err := os.OpenFile(d.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	d.f = f
+
+	if err := d.driverIoctl(usbdevfsDisconnect); err != nil {
+		logrus.WithError(err).WithField("path", d.path).Debugln("Failed to detach kernel driver")
+	}
+
+	ifno := int32(d.info.Interface)
+	if err := fileIoctl(d.f, usbdevfsClaim, unsafe.Pointer(&ifno)); err != nil {
+		d.f.Close()
+		d.f = nil
+		return errors.Wrap(err, "failed to claim usb interface")
+	}
+
+	return nil
+}
+
+// Close releases the interface back to the kernel driver and closes the
+// device file, a pending read fails. The device can't be opened again.
+func (d *usbfsDevice) Close() {
+	if d.f == nil {
+		return
+	}
+
+	ifno := int32(d.info.Interface)
+	fileIoctl(d.f, usbdevfsRelease, unsafe.Pointer(&ifno))
+	if err := d.driverIoctl(usbdevfsConnect); err != nil {
+		logrus.WithError(err).WithField("path", d.path).Debugln("Failed to attach kernel driver")
+	}
+
+	d.f.Close()
+}
+
+// driverIoctl detaches or attaches the kernel driver of the interface
+func (d *usbfsDevice) driverIoctl(code uintptr) error {
+	req := usbdevfsIoctl{
+		Interface: int32(d.info.Interface),
+		Code:      int32(code),
+	}
+	return fileIoctl(d.f, usbdevfsIoctlReq, unsafe.Pointer(&req))
+}
+
+// Info returns the information of the interface
+func (d *usbfsDevice) Info() hid.Info {
+	return d.info
+}
+
+// OutputEndpoint returns the interrupt OUT endpoint of the interface, 0 if
+// there's none
+func (d *usbfsDevice) OutputEndpoint() int {
+	return d.epOut
+}
+
+// Control sends a control transfer to the device, it returns the number of
+// bytes transferred
+func (d *usbfsDevice) Control(rtype, req, val, index int, data []byte, timeout time.Duration) (int, error) {
+	if d.f == nil {
+		return 0, errors.New("usb device not opened")
+	}
+
+	t := usbdevfsCtrlTransfer{
+		RequestType: uint8(rtype),
+		Request:     uint8(req),
+		Value:       uint16(val),
+		Index:       uint16(index),
+		Length:      uint16(len(data)),
+		Timeout:     uint32(timeout / time.Millisecond),
+	}
+	if len(data) > 0 {
+		t.Data = unsafe.Pointer(&data[0])
+	}
+	return fileIoctlRet(d.f, usbdevfsControl, unsafe.Pointer(&t))
+}
+
+// interrupt sends or receives data on the interrupt endpoint
+func (d *usbfsDevice) interrupt(ep int, data []byte, timeout time.Duration) (int, error) {
+	if d.f == nil {
+		return 0, errors.New("usb device not opened")
+	}
+
+	t := usbdevfsBulkTransfer{
+		Endpoint: uint32(ep),
+		Length:   uint32(len(data)),
+		Timeout:  uint32(timeout / time.Millisecond),
+	}
+	if len(data) > 0 {
+		t.Data = unsafe.Pointer(&data[0])
+	}
+	return fileIoctlRet(d.f, usbdevfsBulk, unsafe.Pointer(&t))
+}
+
+// HIDReport reads the report descriptor of the interface
+func (d *usbfsDevice) HIDReport() ([]byte, error) {
+	buf := make([]byte, hidMaxDescriptorSize)
+	n, err := d.Control(
+		usbReqTypeStandardIn, usbReqGetDescriptor,
+		usbDescReport<<8, int(d.info.Interface), buf, usbControlTimeout,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// GetReport reads the feature report with the given ID
+func (d *usbfsDevice) GetReport(id int) ([]byte, error) {
+	buf := make([]byte, 256)
+	n, err := d.Control(
+		usbReqTypeClassIn, usbReqGetReport,
+		int(ReportFeature)<<8|id, int(d.info.Interface), buf, usbControlTimeout,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// SetReport sends the feature report with the given ID
+func (d *usbfsDevice) SetReport(id int, data []byte) error {
+	_, err := d.Control(
+		usbReqTypeClassOut, usbReqSetReport,
+		int(ReportFeature)<<8|id, int(d.info.Interface), data, usbControlTimeout,
+	)
+	return err
+}
+
+// Read reads an input report from the interrupt IN endpoint, size is the max
+// packet size of the endpoint if it's negative
+func (d *usbfsDevice) Read(size int, timeout time.Duration) ([]byte, error) {
+	if size < 0 {
+		size = d.inSize
+	}
+
+	buf := make([]byte, size)
+	n, err := d.interrupt(d.epIn, buf, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Write sends an output report on the interrupt OUT endpoint, or by
+// SET_REPORT if there's none
+func (d *usbfsDevice) Write(data []byte, timeout time.Duration) (int, error) {
+	if d.epOut > 0 {
+		return d.interrupt(d.epOut, data, timeout)
+	}
+
+	return d.Control(
+		usbReqTypeClassOut, usbReqSetReport,
+		int(ReportOutput)<<8, int(d.info.Interface), data, timeout,
+	)
+}
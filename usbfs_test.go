@@ -0,0 +1,83 @@
+package btk
+
+import (
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/zserge/hid"
+)
+
+// testUsbfsDesc is a keyboard with a boot keyboard interface, a media key
+// interface with an OUT endpoint, and a vendor interface
+var testUsbfsDesc = []byte{
+	// device 046d:c31c rev 64.00
+	0x12, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x08,
+	0x6d, 0x04, 0x1c, 0xc3, 0x00, 0x64, 0x01, 0x02, 0x00, 0x01,
+	// configuration
+	0x09, 0x02, 0x5b, 0x00, 0x03, 0x01, 0x00, 0xa0, 0x32,
+	// interface 0, HID boot keyboard
+	0x09, 0x04, 0x00, 0x00, 0x01, 0x03, 0x01, 0x01, 0x00,
+	0x09, 0x21, 0x10, 0x01, 0x00, 0x01, 0x22, 0x3b, 0x00,
+	0x07, 0x05, 0x81, 0x03, 0x08, 0x00, 0x0a,
+	// interface 1, HID with an OUT endpoint
+	0x09, 0x04, 0x01, 0x00, 0x02, 0x03, 0x00, 0x00, 0x00,
+	0x09, 0x21, 0x10, 0x01, 0x00, 0x01, 0x22, 0x54, 0x00,
+	0x07, 0x05, 0x82, 0x03, 0x10, 0x00, 0x0a,
+	0x07, 0x05, 0x02, 0x03, 0x10, 0x00, 0x0a,
+	// interface 1 alternate setting
+	0x09, 0x04, 0x01, 0x01, 0x00, 0x03, 0x00, 0x00, 0x00,
+	// interface 2, vendor specific
+	0x09, 0x04, 0x02, 0x00, 0x01, 0xff, 0x00, 0x00, 0x00,
+	0x07, 0x05, 0x83, 0x02, 0x40, 0x00, 0x00,
+}
+
+func TestParseUsbfsDesc(t *testing.T) {
+	const path = "/dev/bus/usb/001/004"
+	info := hid.Info{Vendor: 0x046d, Product: 0xc31c, Revision: 0x6400}
+
+	keyboard, media := info, info
+	keyboard.SubClass = 1
+	keyboard.Protocol = protocolKeyboard
+	media.Interface = 1
+
+	want := []*usbfsDevice{
+		{info: keyboard, path: path, epIn: 0x81, inSize: 8},
+		{info: media, path: path, epIn: 0x82, epOut: 0x02, inSize: 16},
+	}
+
+	if got := parseUsbfsDesc(path, testUsbfsDesc); !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+
+	// a truncated descriptor keeps the interfaces before it
+	if got := parseUsbfsDesc(path, testUsbfsDesc[:60]); len(got) != 1 || got[0].epIn != 0x81 {
+		t.Errorf("parsed %+v from a truncated descriptor", got)
+	}
+}
+
+func TestUsbdevfsLayouts(t *testing.T) {
+	ptr := unsafe.Sizeof(uintptr(0))
+
+	// sizes of the structs in linux/usbdevice_fs.h, the pointer at the end is
+	// aligned to its size
+	tests := []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"sizeof(struct usbdevfs_ctrltransfer)", unsafe.Sizeof(usbdevfsCtrlTransfer{}), 12 + (ptr-12%ptr)%ptr + ptr},
+		{"sizeof(struct usbdevfs_bulktransfer)", unsafe.Sizeof(usbdevfsBulkTransfer{}), 12 + (ptr-12%ptr)%ptr + ptr},
+		{"sizeof(struct usbdevfs_ioctl)", unsafe.Sizeof(usbdevfsIoctl{}), 8 + ptr},
+		{"USBDEVFS_CLAIMINTERFACE", usbdevfsClaim, 0x8004550f},
+		{"USBDEVFS_RELEASEINTERFACE", usbdevfsRelease, 0x80045510},
+		{"USBDEVFS_DISCONNECT", usbdevfsDisconnect, 0x5516},
+		{"USBDEVFS_CONNECT", usbdevfsConnect, 0x5517},
+	}
+
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s is %#x, want %#x", test.name, test.got, test.want)
+		}
+	}
+}